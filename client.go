@@ -1,20 +1,30 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"github.com/bhpike65/go-stun/nat"
 	"net"
 	"os"
+	"os/signal"
 )
 
-var server = flag.String("server", "stun.l.google.com:19302", "STUN server to query")
-var altServer = flag.String("alt-server", "", "alternative STUN server to query")
+var server = flag.String("server", "stun:stun.l.google.com:19302", "STUN server to query, stun:host[:port] or host:port")
+var altServer = flag.String("alt-server", "", "alternative STUN server to query, stun:host[:port] or host:port")
 var local = flag.String("local", "", "local ip:port to use")
+var useIpv6 = flag.Bool("ipv6", false, "discover the IPv6 mapping, the local address is picked among the IPv6 ones")
+var rto = flag.Duration("rto", nat.ClientOptions.RTO, "initial retransmission timeout")
+var rc = flag.Int("rc", nat.ClientOptions.Rc, "max number of times a request is sent")
+var rm = flag.Int("rm", nat.ClientOptions.Rm, "wait rm times the initial rto for a response after the last request")
 
 func main() {
 	flag.Parse()
 
+	nat.ClientOptions.RTO = *rto
+	nat.ClientOptions.Rc = *rc
+	nat.ClientOptions.Rm = *rm
+
 	if *local == "" {
 		addrs, err := net.InterfaceAddrs()
 		if err != nil {
@@ -23,14 +33,25 @@ func main() {
 		}
 		for _, a := range addrs {
 			if ipnet, ok := a.(*net.IPNet); ok && !ipnet.IP.IsLoopback() {
-				if ipnet.IP.To4() != nil {
+				if *useIpv6 {
+					if ipnet.IP.To4() == nil && ipnet.IP.IsGlobalUnicast() {
+						*local = net.JoinHostPort(ipnet.IP.String(), "0")
+					}
+				} else if ipnet.IP.To4() != nil {
 					*local = ipnet.IP.String() + ":0"
 				}
 			}
 		}
+		if *local == "" {
+			fmt.Println("no usable local address found, set it with -local")
+			os.Exit(-1)
+		}
 	}
 
-	res, err := nat.Discovery(*local, *server, *altServer)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	res, err := nat.DiscoveryContext(ctx, *local, *server, *altServer)
 	if err != nil {
 		fmt.Println("nat discovery error: ", err.Error())
 		os.Exit(-1)
@@ -1,6 +1,7 @@
 package nat
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"github.com/bhpike65/go-stun/stun"
@@ -26,23 +27,39 @@ type NATBehaviorDiscovery struct {
 	MappingAddr   string
 	MappingType   int
 	FilteringType int
-	Hairpinning	  bool
+	Hairpinning   bool
 }
 
+// ClientOptions are the retransmission parameters of the discovery requests.
+var ClientOptions = stun.DefaultClientOptions
+
+func newBindRequest() *stun.StunMessageReq {
+	req := stun.NewBindRequest(nil)
+	req.Options = &ClientOptions
+	return req
+}
 
 func Discovery(local, server, altServer string) (*NATBehaviorDiscovery, error) {
+	return DiscoveryContext(context.Background(), local, server, altServer)
+}
+
+// DiscoveryContext is like Discovery, but it stops and returns ctx.Err() as
+// soon as ctx is done.
+func DiscoveryContext(ctx context.Context, local, server, altServer string) (*NATBehaviorDiscovery, error) {
 	var res NATBehaviorDiscovery
 	var err error
-	res.Server, err = net.ResolveUDPAddr("udp", server)
+	res.Local, err = net.ResolveUDPAddr("udp", local)
 	if err != nil {
 		return nil, err
 	}
-	res.Local, err = net.ResolveUDPAddr("udp", local)
+	// resolve the servers in the family of the local address
+	network := stun.UDPNetwork(res.Local)
+	res.Server, err = resolveServer(ctx, network, server)
 	if err != nil {
 		return nil, err
 	}
 	if altServer != "" {
-		res.AltServer, err = net.ResolveUDPAddr("udp", altServer)
+		res.AltServer, err = resolveServer(ctx, network, altServer)
 		if err != nil {
 			return nil, err
 		}
@@ -56,9 +73,12 @@ func Discovery(local, server, altServer string) (*NATBehaviorDiscovery, error) {
 	res.LocalAddr = conn.LocalAddr().String()
 
 	// testI: NO-NAT?
-	req := stun.NewBindRequest(nil)
-	resp, localAddr, err := req.RequestTo(conn, res.Server)
+	req := newBindRequest()
+	resp, localAddr, err := req.RequestToContext(ctx, conn, res.Server)
 	if err != nil {
+		if ctx.Err() != nil {
+			return &res, ctx.Err()
+		}
 		return &res, errors.New(fmt.Sprintf("Failed to build STUN PP request: %s", err.Error()))
 	}
 
@@ -80,13 +100,13 @@ func Discovery(local, server, altServer string) (*NATBehaviorDiscovery, error) {
 		altIp := other.IP
 		altPort := other.Port
 		// testII， send to alternativeIp:primaryPort
-		req = stun.NewBindRequest(nil)
-		remoteAP, err := net.ResolveUDPAddr("udp", fmt.Sprintf("%s:%d", altIp.String(), primaryPort))
-		if err != nil {
-			return &res, errors.New(fmt.Sprintf("resolve AP address failed:%s", err.Error()))
-		}
-		resp, localAddr, err = req.RequestTo(conn, remoteAP)
+		req = newBindRequest()
+		remoteAP := &net.UDPAddr{IP: altIp, Port: primaryPort}
+		resp, localAddr, err = req.RequestToContext(ctx, conn, remoteAP)
 		if err != nil {
+			if ctx.Err() != nil {
+				return &res, ctx.Err()
+			}
 			return &res, errors.New(fmt.Sprintf("Failed to build STUN AP request:%s", err.Error()))
 		}
 		mappingAP := resp.Addr.String()
@@ -94,13 +114,13 @@ func Discovery(local, server, altServer string) (*NATBehaviorDiscovery, error) {
 			res.MappingType = NAT_TYPE_EIM
 		} else {
 			//testIII, send to alternativeIp:alternativePort
-			req = stun.NewBindRequest(nil)
-			remoteAA, err := net.ResolveUDPAddr("udp", fmt.Sprintf("%s:%d", altIp.String(), altPort))
-			if err != nil {
-				return &res, errors.New(fmt.Sprintf("resolve AA address failed:%s", err.Error()))
-			}
-			resp, localAddr, err = req.RequestTo(conn, remoteAA)
+			req = newBindRequest()
+			remoteAA := &net.UDPAddr{IP: altIp, Port: altPort}
+			resp, localAddr, err = req.RequestToContext(ctx, conn, remoteAA)
 			if err != nil {
+				if ctx.Err() != nil {
+					return &res, ctx.Err()
+				}
 				return &res, errors.New(fmt.Sprintf("Failed to build STUN AA request:%s", err.Error()))
 			}
 			mappingAA := resp.Addr.String()
@@ -117,19 +137,25 @@ func Discovery(local, server, altServer string) (*NATBehaviorDiscovery, error) {
 	if alternative != nil {
 		//start NAT filter behavior test
 		//test II
-		req = stun.NewBindRequest(nil)
+		req = newBindRequest()
 		req.SetChangeIP(true)
 		req.SetChangePort(true)
-		_, _, err = req.RequestTo(conn, res.Server)
+		_, _, err = req.RequestToContext(ctx, conn, res.Server)
+		if ctx.Err() != nil {
+			return &res, ctx.Err()
+		}
 		if err == nil {
 			res.FilteringType = NAT_TYPE_EIF
 		} else {
 			//test III
-			req = stun.NewBindRequest(nil)
+			req = newBindRequest()
 			req.SetChangeIP(false)
 			req.SetChangePort(true)
-			req.ValidateSource(fmt.Sprintf("%s:%d", res.Server.IP.String(), alternative.Port))
-			resp, _, err = req.RequestTo(conn, res.Server)
+			req.ValidateSource((&net.UDPAddr{IP: res.Server.IP, Port: alternative.Port}).String())
+			resp, _, err = req.RequestToContext(ctx, conn, res.Server)
+			if ctx.Err() != nil {
+				return &res, ctx.Err()
+			}
 			if err == nil {
 				res.FilteringType = NAT_TYPE_ADF
 			} else if resp != nil {
@@ -143,8 +169,11 @@ func Discovery(local, server, altServer string) (*NATBehaviorDiscovery, error) {
 	}
 
 	//hairpinning support test
-	req = stun.NewBindRequest(nil)
-	_, _, err = req.Request(res.Local.IP.String()+":0", mappingPP)
+	req = newBindRequest()
+	_, _, err = req.RequestContext(ctx, (&net.UDPAddr{IP: res.Local.IP}).String(), mappingPP)
+	if ctx.Err() != nil {
+		return &res, ctx.Err()
+	}
 	if err == nil {
 		res.Hairpinning = true
 	}
@@ -152,6 +181,31 @@ func Discovery(local, server, altServer string) (*NATBehaviorDiscovery, error) {
 	return &res, nil
 }
 
+// resolveServer accepts host:port, a domain looked up in the SRV records or a
+// stun: URI, the behavior tests can only run over plain UDP. The tests need
+// one fixed server, the first one of a domain that resolves is used.
+func resolveServer(ctx context.Context, network, server string) (*net.UDPAddr, error) {
+	u, err := stun.ParseServer(server)
+	if err != nil {
+		return nil, err
+	}
+	if u.Secure() || u.Network() != "udp" {
+		return nil, errors.New(fmt.Sprintf("%s: NAT behavior discovery needs a stun: server over udp", server))
+	}
+	servers, err := stun.LookupServers(ctx, stun.DefaultResolver, u)
+	if err != nil {
+		return nil, err
+	}
+
+	var addr *net.UDPAddr
+	for _, s := range servers {
+		if addr, err = net.ResolveUDPAddr(network, s); err == nil {
+			return addr, nil
+		}
+	}
+	return nil, err
+}
+
 func (d *NATBehaviorDiscovery) String() string {
 	ret := fmt.Sprintf("localAddress:%s, mappingAddress:%s\n", d.LocalAddr, d.MappingAddr)
 	switch d.MappingType {
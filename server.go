@@ -1,30 +1,23 @@
 package main
 
 import (
-	"bufio"
-	"encoding/hex"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"flag"
 	"fmt"
+	"github.com/bhpike65/go-stun/server"
 	"github.com/bhpike65/go-stun/stun"
-	"io"
 	"log"
 	"net"
 	"os"
+	"os/signal"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 )
 
-const (
-	typePP = iota // primaryAddr:primaryPort
-	typePA        // primaryAddr:alterAddr
-	typeAP        // alterAddr:primaryPort
-	typeAA        // alterAddr:alterAddr
-	typeMax
-)
-
-var roleSet [typeMax]*net.UDPConn
-
-var logger *log.Logger
-
 // ./stunserver --primaryAddr 1.1.1.1 --alternativeAddr 2.2.2.2 --primaryPort 3478 --alternativePort 3479
 // ./stunserver --slaveserver 2.2.2.2:12345 --primaryAddr 1.1.1.1 --primaryPort 3478 --alternativePort 3479
 // ./stunserver --slave --slaveserver 2.2.2.2:12345 --primaryPort 3478 --alternativePort 3479
@@ -33,12 +26,36 @@ var primaryAddr = flag.String("primary-addr", "", "STUN server primary address")
 var alterAddr = flag.String("alt-addr", "", "STUN server alternative address")
 var primaryPort = flag.Int("primary-port", 3478, "primary port")
 var alterPort = flag.Int("alt-port", 3479, "alternative port")
-var slaveServer = flag.String("slaveserver", "", "slave STUN server which has alternative Ip")
+var slaveServer = flag.String("slaveserver", "", "slave STUN server which has alternative Ip, a comma separated list for several slaves of a master")
+var slavePolicy = flag.String("slave-policy", "hash", "how a master with several slaves picks the slave of a client: hash or round-robin")
 
 var isSlave = flag.Bool("slave", false, "this is a slave stun server")
+var slaveSecret = flag.String("slave-secret", "", "secret shared by the master and the slave, authenticates the requests forwarded to the slave")
+var slaveCert = flag.String("slave-cert", "", "certificate file, run the master/slave link over mutual TLS")
+var slaveKey = flag.String("slave-key", "", "private key file of the slave link certificate")
+var slaveInsecure = flag.Bool("slave-insecure", false, "run the slave link without -slave-secret nor -slave-cert, anyone reaching the slave can make it send responses")
+var slaveCA = flag.String("slave-ca", "", "CA file verifying the certificate of the other end of the slave link")
+var slaveQueue = flag.Int("slave-queue", 128, "number of requests queued for the slave, the oldest is dropped when it is full")
+var slaveHeartbeat = flag.Duration("slave-heartbeat", 5*time.Second, "heartbeat interval of the slave link, the same on the master and the slave")
+var slaveNetwork = flag.String("slave-network", "tcp", "transport of the slave link, tcp or udp, the same on the master and the slave")
 var public = flag.Bool("public", true, "primaryAddr and alternativeAddr must be public ip address")
+var password = flag.String("password", "", "short-term credential password, requests without MESSAGE-INTEGRITY are answered with 400 Bad Request, the ones with a wrong one with 401 Unauthorized")
+var realm = flag.String("realm", "", "enable the long-term credential mechanism in this realm")
+var users = flag.String("users", "", "long-term credential users, user1:password1,user2:password2")
 
-var slaveChan chan *string
+var tcpServer = flag.Bool("tcp", false, "serve STUN over TCP on primary-addr:primary-port as well")
+var tlsCert = flag.String("tls-cert", "", "certificate file, serve STUN over TLS on primary-addr:tls-port")
+var tlsKey = flag.String("tls-key", "", "private key file of the TLS certificate")
+var tlsPort = flag.Int("tls-port", 5349, "STUN over TLS port")
+var dtlsPort = flag.Int("dtls-port", 0, "serve STUN over DTLS on primary-addr:dtls-port with the TLS certificate, requires -tls-cert, 5349 is the usual port")
+var maxConns = flag.Int("max-conns", 1024, "number of TCP, TLS and DTLS connections served at once")
+var connIdleTimeout = flag.Duration("conn-idle-timeout", 5*time.Minute, "close the TCP, TLS and DTLS connections without any request for this long")
+
+var reusePort = flag.Int("reuseport", 1, "number of SO_REUSEPORT sockets per address, to spread the requests among cores")
+var readers = flag.Int("readers", 1, "number of goroutines reading each socket")
+var batch = flag.Int("batch", 1, "number of packets read and written per system call (recvmmsg/sendmmsg)")
+
+var logPath = flag.String("log-file", "./slave.log", "log file, reopened on SIGHUP")
 
 var lanNets = []*net.IPNet{
 	{net.IPv4(10, 0, 0, 0), net.CIDRMask(8, 32)},
@@ -47,15 +64,156 @@ var lanNets = []*net.IPNet{
 	{net.ParseIP("fc00"), net.CIDRMask(7, 128)},
 }
 
+// logFile is the log file of the server, reopened on SIGHUP so that it can
+// be rotated by logrotate.
+type logFile struct {
+	mu   sync.Mutex
+	path string
+	file *os.File
+}
+
+func openLogFile(path string) (*logFile, error) {
+	l := &logFile{path: path}
+	if err := l.reopen(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *logFile) reopen() error {
+	file, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0666)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	old := l.file
+	l.file = file
+	l.mu.Unlock()
+	if old != nil {
+		old.Close()
+	}
+	return nil
+}
+
+func (l *logFile) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.file.Write(p)
+}
+
+// Close flushes the log file to disk and closes it.
+func (l *logFile) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.file.Sync()
+	return l.file.Close()
+}
+
 func main() {
 	flag.Parse()
 
-	logFile, err := os.OpenFile("./slave.log", os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0666)
+	logOut, err := openLogFile(*logPath)
 	if err != nil {
-		fmt.Println("failed to create slave.log: ", err.Error())
+		fmt.Printf("failed to create %s: %s\n", *logPath, err.Error())
 		os.Exit(-1)
 	}
-	logger = log.New(logFile, "", log.Llongfile|log.LstdFlags)
+	logger := log.New(logOut, "", log.Llongfile|log.LstdFlags)
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := logOut.reopen(); err != nil {
+				logger.Println("reopen log file failed: ", err.Error())
+			}
+		}
+	}()
+
+	config := server.Config{
+		PrimaryPort:     *primaryPort,
+		AltPort:         *alterPort,
+		SlaveServer:     *slaveServer,
+		Slave:           *isSlave,
+		SlaveSecret:     *slaveSecret,
+		SlaveInsecure:   *slaveInsecure,
+		SlaveQueue:      *slaveQueue,
+		SlaveHeartbeat:  *slaveHeartbeat,
+		SlaveNetwork:    *slaveNetwork,
+		Password:        *password,
+		TCP:             *tcpServer,
+		TLSPort:         *tlsPort,
+		DTLSPort:        *dtlsPort,
+		MaxConns:        *maxConns,
+		ConnIdleTimeout: *connIdleTimeout,
+		ReusePort:       *reusePort,
+		Readers:         *readers,
+		Batch:           *batch,
+		Logger:          logger,
+	}
+
+	if !*isSlave && strings.Contains(*slaveServer, ",") {
+		config.SlaveServer = ""
+		for _, addr := range strings.Split(*slaveServer, ",") {
+			if addr != "" {
+				config.SlaveServers = append(config.SlaveServers, addr)
+			}
+		}
+	}
+	switch *slavePolicy {
+	case "hash":
+		config.SlavePolicy = server.SlaveHash
+	case "round-robin":
+		config.SlavePolicy = server.SlaveRoundRobin
+	default:
+		logger.Fatalf("bad slave policy %q, expect hash or round-robin", *slavePolicy)
+	}
+
+	if *realm != "" {
+		creds := make(stun.StaticCredentials)
+		for _, user := range strings.Split(*users, ",") {
+			if user == "" {
+				continue
+			}
+			kv := strings.SplitN(user, ":", 2)
+			if len(kv) != 2 {
+				logger.Fatalf("bad user %q, expect user:password", user)
+			}
+			creds[kv[0]] = kv[1]
+		}
+		if config.Auth, err = stun.NewLongTermAuth(*realm, creds); err != nil {
+			logger.Fatal(err)
+		}
+	}
+
+	if *tlsCert != "" {
+		cert, err := tls.LoadX509KeyPair(*tlsCert, *tlsKey)
+		if err != nil {
+			logger.Fatal("load tls certificate failed: ", err.Error())
+		}
+		config.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	}
+
+	if *slaveCert != "" {
+		cert, err := tls.LoadX509KeyPair(*slaveCert, *slaveKey)
+		if err != nil {
+			logger.Fatal("load slave link certificate failed: ", err.Error())
+		}
+		pem, err := os.ReadFile(*slaveCA)
+		if err != nil {
+			logger.Fatal("read slave link CA failed: ", err.Error())
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			logger.Fatal("no certificate in ", *slaveCA)
+		}
+		config.SlaveTLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+		if *isSlave {
+			config.SlaveTLSConfig.ClientAuth = tls.RequireAndVerifyClientCert
+			config.SlaveTLSConfig.ClientCAs = pool
+		} else {
+			config.SlaveTLSConfig.RootCAs = pool
+		}
+	}
 
 	if *primaryAddr == "" || *alterAddr == "" {
 		addrs, err := net.InterfaceAddrs()
@@ -90,176 +248,24 @@ func main() {
 			}
 		}
 	}
+	config.PrimaryAddr = *primaryAddr
+	config.AltAddr = *alterAddr
 
-	roleSet[typePP], err = net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP(*primaryAddr), Port: *primaryPort})
-	if err != nil {
-		logger.Fatal("listen on PP failed")
-	}
-	roleSet[typePA], err = net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP(*primaryAddr), Port: *alterPort})
+	srv, err := server.New(config)
 	if err != nil {
-		logger.Fatal("listen on PA failed")
+		logger.Fatal(err)
 	}
 
-	if *isSlave && *alterAddr != "" {
-		*alterAddr = ""
-	}
-	var aaAddr *net.UDPAddr
-	if *alterAddr == "" {
-		if *isSlave == false {
-			if *slaveServer != "" {
-				slaveAddr, err := net.ResolveTCPAddr("tcp", *slaveServer)
-				if err != nil {
-					logger.Fatal("slave server resolve failed")
-				}
-				slaveChan = make(chan *string, 128)
-				go slaveClientWorker(slaveAddr)
-				aaAddr = &net.UDPAddr{IP: slaveAddr.IP, Port: *alterPort}
-			}
-		} else if *slaveServer != "" {
-			slaveAddr, err := net.ResolveTCPAddr("tcp", *slaveServer)
-			if err != nil {
-				logger.Fatal("slave server resolve failed")
-			}
-			go slaveWorker(slaveAddr)
-		}
-	} else {
-		aaAddr, err = net.ResolveUDPAddr("udp", fmt.Sprintf("%s:%d", *alterAddr, *alterPort))
-		if err != nil {
-			logger.Fatalf("alterAddr %s:%d resolve failed", *alterAddr, alterPort)
-		}
-		roleSet[typeAP], err = net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP(*alterAddr), Port: *primaryPort})
-		if err != nil {
-			logger.Fatal("listen on PP failed")
-		}
-		roleSet[typeAA], err = net.ListenUDP("udp", aaAddr)
-		if err != nil {
-			logger.Fatal("listen on PA failed")
-		}
-
-		go startStunServer(typeAP, roleSet[typeAP], nil)
-		go startStunServer(typeAA, roleSet[typeAA], nil)
-	}
-
-	go startStunServer(typePA, roleSet[typePA], nil)
-	startStunServer(typePP, roleSet[typePP], aaAddr)
-}
-
-func startStunServer(role int, conn *net.UDPConn, other *net.UDPAddr) {
-	buf := make([]byte, 1500)
-	for {
-		n, remote, err := conn.ReadFromUDP(buf)
-		if err != nil {
-			logger.Println("receive Error: ", err)
-		}
-		var req stun.StunMessageReq
-		if err = req.Unmarshal(buf[:n]); err != nil {
-			logger.Println("receive error req: ", err.Error())
-			continue
-		}
-		otherRole := role
-		if req.ChangeIp {
-			otherRole ^= 0x02
-		}
-		if req.ChangePort {
-			otherRole ^= 0x01
-		}
-		if otherRole != role {
-			if slaveChan != nil {
-				info := fmt.Sprintf("%s|%x\n", remote.String(), req.TransacrtonId)
-				go sendToSlave(&info)
-				continue
-			} else if *alterAddr != "" && roleSet[otherRole] != nil {
-				if err = req.RespondTo(roleSet[otherRole], remote, nil); err != nil {
-					logger.Printf("respond to %s failed %s", remote, err.Error())
-				}
-			} else {
-				//ignore
-				continue
-			}
-		} else {
-			if err = req.RespondTo(conn, remote, other); err != nil {
-				logger.Printf("respond to %s failed %s", remote, err.Error())
-			}
-		}
-	}
-}
-
-func sendToSlave(info *string) {
-	//ip:port|transactionId\n
-	slaveChan <- info
-}
-
-func slaveClientWorker(slaveServer *net.TCPAddr) {
-
-	for {
-		conn, err := net.DialTCP("tcp", nil, slaveServer)
-		if err != nil {
-			logger.Fatal("Dial slave server failed:", err.Error())
-		}
-
-		for {
-			data := <-slaveChan
-			conn.SetNoDelay(true)
-			_, err = conn.Write([]byte(*data))
-			if err != nil {
-				fmt.Println("Write to slave server failed:", err.Error())
-				conn.Close()
-				break
-			}
-		}
-	}
-}
-
-func slaveWorker(slaveServer *net.TCPAddr) {
-	l, err := net.ListenTCP("tcp", slaveServer)
-	if err != nil {
-		logger.Fatal("slave tcp listen error: ", err.Error())
-		os.Exit(-1)
-	}
-	defer l.Close()
-
-	for {
-		conn, err := l.AcceptTCP()
-		if err != nil {
-			logger.Fatal("slave accept error:", err.Error())
-			continue
-		}
-		go slaveProcessRequest(conn)
-	}
-}
-
-func slaveProcessRequest(conn net.Conn) {
-	defer conn.Close()
-
-	reader := bufio.NewReaderSize(conn, 128)
-	for {
-		data, err := reader.ReadString('\n')
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			logger.Println("read from tcp socket failed:", err.Error())
-			break
-		}
-		data = strings.TrimRight(data, "\n")
-		logger.Println("slave get: ", data)
-		infos := strings.Split(data, "|")
-		if len(infos) != 2 {
-			logger.Print("receive error slave data: ", data)
-			continue
-		}
-		addr := infos[0]
-		tid, err := hex.DecodeString(infos[1])
-		if err != nil || len(tid) != 12 {
-			logger.Print("receive error slave data: ", data)
-			continue
-		}
-		remote, err := net.ResolveUDPAddr("udp", addr)
-		if err != nil {
-			logger.Print("receive error slave data: ", data)
-			continue
-		}
-		req := stun.NewBindRequest(tid)
-		req.RespondTo(roleSet[typePP], remote, nil)
+	// SIGINT and SIGTERM close the sockets and listeners, the requests queued
+	// for the slave server are forwarded before Serve returns
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	err = srv.Serve(ctx)
+	stop()
+	if err != context.Canceled {
+		logger.Println("server stopped: ", err)
+		logOut.Close()
+		os.Exit(1)
 	}
+	logger.Println("server shut down")
+	logOut.Close()
 }
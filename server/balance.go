@@ -0,0 +1,183 @@
+package server
+
+import (
+	"container/list"
+	"net"
+	"sync"
+	"time"
+)
+
+// SlavePolicy chooses the slave of a master serving a client among the
+// healthy ones. The slave of a client answers its CHANGE-REQUEST and its
+// address is the OTHER-ADDRESS of the responses to the client, so a client
+// keeps its slave as long as the slave is healthy.
+type SlavePolicy int
+
+const (
+	// SlaveHash hashes the IP address of the client over the slaves, the
+	// clients of a failed slave are spread over the others and get it back
+	// once it recovers.
+	SlaveHash SlavePolicy = iota
+	// SlaveRoundRobin gives the new clients to the slaves in turn, a client
+	// keeps its slave while it sends requests within slaveAffinityTTL.
+	SlaveRoundRobin
+)
+
+// slaveAffinityTTL is how long SlaveRoundRobin remembers the slave of a
+// client, slaveMaxClients the number of clients it remembers at most, the
+// least recently seen one of a shard is forgotten for a new one. The clients
+// are spread over slaveShards shards, each with its own lock.
+const (
+	slaveAffinityTTL = 5 * time.Minute
+	slaveMaxClients  = 1 << 16
+	slaveShards      = 16
+)
+
+// slaveBalancer picks the slave of a client with a SlavePolicy.
+type slaveBalancer struct {
+	nodes  []*slaveNode
+	policy SlavePolicy
+
+	// next is the slave of the next new client
+	nextMu sync.Mutex
+	next   int
+	shards [slaveShards]affinityShard
+}
+
+// affinityShard holds the slaves of some clients, clients holds the elements
+// of lru, the affinities from the most to the least recently seen.
+type affinityShard struct {
+	mu      sync.Mutex
+	clients map[[16]byte]*list.Element
+	lru     list.List
+}
+
+type slaveAffinity struct {
+	key  [16]byte
+	node *slaveNode
+	seen time.Time
+}
+
+func newSlaveBalancer(nodes []*slaveNode, policy SlavePolicy) *slaveBalancer {
+	b := &slaveBalancer{nodes: nodes, policy: policy}
+	for i := range b.shards {
+		b.shards[i].clients = make(map[[16]byte]*list.Element)
+	}
+	return b
+}
+
+// clientKey is ip in its 16-byte form, without allocating for an IPv4 one.
+func clientKey(ip net.IP) [16]byte {
+	var key [16]byte
+	if len(ip) == net.IPv4len {
+		key[10], key[11] = 0xff, 0xff
+		copy(key[12:], ip)
+	} else {
+		copy(key[:], ip)
+	}
+	return key
+}
+
+// pick returns the slave serving the client at ip.
+func (b *slaveBalancer) pick(ip net.IP) *slaveNode {
+	if len(b.nodes) == 1 {
+		return b.nodes[0]
+	}
+	if b.policy == SlaveRoundRobin {
+		return b.pickRoundRobin(ip)
+	}
+	return b.pickHash(ip)
+}
+
+// pickHash is rendezvous hashing: the healthy slave with the highest hash
+// of its address and ip, or the slave with the highest one when none is
+// healthy.
+func (b *slaveBalancer) pickHash(ip net.IP) *slaveNode {
+	var best *slaveNode
+	var bestHealthy bool
+	var bestScore uint64
+	for _, node := range b.nodes {
+		healthy := node.healthy()
+		score := rendezvous(node.addr, ip)
+		if best == nil || (healthy && !bestHealthy) || (healthy == bestHealthy && score > bestScore) {
+			best, bestHealthy, bestScore = node, healthy, score
+		}
+	}
+	return best
+}
+
+// rendezvous hashes the address of a slave and the ip of a client with
+// FNV-1a, mixed by the finalizer of SplitMix64 so that close addresses give
+// unrelated scores.
+func rendezvous(slave *net.TCPAddr, ip net.IP) uint64 {
+	h := uint64(14695981039346656037)
+	for _, c := range slave.IP.To16() {
+		h = (h ^ uint64(c)) * 1099511628211
+	}
+	h = (h ^ uint64(slave.Port>>8)) * 1099511628211
+	h = (h ^ uint64(slave.Port&0xff)) * 1099511628211
+	for _, c := range clientKey(ip) {
+		h = (h ^ uint64(c)) * 1099511628211
+	}
+	h = (h ^ h>>30) * 0xbf58476d1ce4e5b9
+	h = (h ^ h>>27) * 0x94d049bb133111eb
+	return h ^ h>>31
+}
+
+// shard returns the shard of the client key.
+func (b *slaveBalancer) shard(key [16]byte) *affinityShard {
+	h := uint32(2166136261)
+	for _, c := range key {
+		h = (h ^ uint32(c)) * 16777619
+	}
+	return &b.shards[h%slaveShards]
+}
+
+func (b *slaveBalancer) pickRoundRobin(ip net.IP) *slaveNode {
+	now := time.Now()
+	key := clientKey(ip)
+	sh := b.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	// the expired clients are the least recently seen
+	for e := sh.lru.Back(); e != nil && now.Sub(e.Value.(*slaveAffinity).seen) > slaveAffinityTTL; e = sh.lru.Back() {
+		delete(sh.clients, sh.lru.Remove(e).(*slaveAffinity).key)
+	}
+
+	e := sh.clients[key]
+	if e != nil {
+		sh.lru.MoveToFront(e)
+		if a := e.Value.(*slaveAffinity); a.node.healthy() {
+			a.seen = now
+			return a.node
+		}
+	}
+	node := b.nextHealthy()
+	if e == nil {
+		if len(sh.clients) >= slaveMaxClients/slaveShards {
+			delete(sh.clients, sh.lru.Remove(sh.lru.Back()).(*slaveAffinity).key)
+		}
+		e = sh.lru.PushFront(&slaveAffinity{key: key})
+		sh.clients[key] = e
+	}
+	a := e.Value.(*slaveAffinity)
+	a.node, a.seen = node, now
+	return node
+}
+
+// nextHealthy returns the next healthy slave in turn, or the next one when
+// none is healthy.
+func (b *slaveBalancer) nextHealthy() *slaveNode {
+	b.nextMu.Lock()
+	defer b.nextMu.Unlock()
+	node := b.nodes[b.next%len(b.nodes)]
+	for i := range b.nodes {
+		if n := b.nodes[(b.next+i)%len(b.nodes)]; n.healthy() {
+			node = n
+			b.next += i
+			break
+		}
+	}
+	b.next++
+	return node
+}
@@ -0,0 +1,188 @@
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func testNodes(n int) []*slaveNode {
+	nodes := make([]*slaveNode, n)
+	for i := range nodes {
+		nodes[i] = newSlaveNode(&net.TCPAddr{IP: net.IPv4(192, 0, 2, byte(i+1)), Port: 12345}, &Config{AltPort: 3479, SlaveQueue: 1})
+		nodes[i].setHealthy(true)
+	}
+	return nodes
+}
+
+func clientIP(i int) net.IP {
+	return net.IPv4(10, byte(i>>16), byte(i>>8), byte(i))
+}
+
+func TestSlaveHash(t *testing.T) {
+	nodes := testNodes(3)
+	b := newSlaveBalancer(nodes, SlaveHash)
+
+	const clients = 3000
+	before := make([]*slaveNode, clients)
+	count := make(map[*slaveNode]int)
+	for i := range before {
+		before[i] = b.pick(clientIP(i))
+		count[before[i]]++
+		if b.pick(clientIP(i)) != before[i] {
+			t.Fatalf("client %d changed slave", i)
+		}
+	}
+	for _, node := range nodes {
+		if count[node] < clients/3*8/10 {
+			t.Errorf("slave %s serves %d clients of %d", node.addr, count[node], clients)
+		}
+	}
+
+	// only the clients of a failed slave move, and come back to it
+	nodes[1].setHealthy(false)
+	for i, node := range before {
+		if got := b.pick(clientIP(i)); got == nodes[1] || (node != nodes[1] && got != node) {
+			t.Fatalf("client %d of %s moved to %s", i, node.addr, got.addr)
+		}
+	}
+	nodes[1].setHealthy(true)
+	for i, node := range before {
+		if b.pick(clientIP(i)) != node {
+			t.Fatalf("client %d didn't get %s back", i, node.addr)
+		}
+	}
+
+	// without healthy slave a client still has one
+	for _, node := range nodes {
+		node.setHealthy(false)
+	}
+	if b.pick(clientIP(0)) != before[0] {
+		t.Error("client moved while no slave is healthy")
+	}
+}
+
+func TestSlaveRoundRobin(t *testing.T) {
+	nodes := testNodes(3)
+	b := newSlaveBalancer(nodes, SlaveRoundRobin)
+	for i := 0; i < 6; i++ {
+		if got := b.pick(clientIP(i)); got != nodes[i%3] {
+			t.Errorf("client %d got %s, want %s", i, got.addr, nodes[i%3].addr)
+		}
+	}
+	if b.pick(clientIP(1)) != nodes[1] {
+		t.Error("client changed slave")
+	}
+
+	nodes[1].setHealthy(false)
+	if got := b.pick(clientIP(1)); got == nodes[1] {
+		t.Error("client kept a failed slave")
+	}
+	// new clients skip the failed slave
+	for i := 6; i < 12; i++ {
+		if b.pick(clientIP(i)) == nodes[1] {
+			t.Errorf("client %d got the failed slave", i)
+		}
+	}
+
+	// forgotten clients
+	for i := range b.shards {
+		for e := b.shards[i].lru.Front(); e != nil; e = e.Next() {
+			e.Value.(*slaveAffinity).seen = time.Now().Add(-2 * slaveAffinityTTL)
+		}
+	}
+	key := clientKey(clientIP(0))
+	sh := b.shard(key)
+	b.pick(clientIP(0))
+	if e := sh.clients[key]; e == nil || sh.lru.Len() != 1 || !time.Now().After(e.Value.(*slaveAffinity).seen) {
+		t.Errorf("expired clients not forgotten, %d left", sh.lru.Len())
+	}
+}
+
+func TestSlaveRoundRobinFull(t *testing.T) {
+	nodes := testNodes(3)
+	b := newSlaveBalancer(nodes, SlaveRoundRobin)
+	for i := 0; i < slaveMaxClients; i++ {
+		b.pick(clientIP(i))
+	}
+	remembered := func(i int) bool {
+		key := clientKey(clientIP(i))
+		_, ok := b.shard(key).clients[key]
+		return ok
+	}
+	clients := func() (n int) {
+		for i := range b.shards {
+			if b.shards[i].lru.Len() != len(b.shards[i].clients) {
+				t.Fatalf("shard %d: %d clients, %d in the list", i, len(b.shards[i].clients), b.shards[i].lru.Len())
+			}
+			n += len(b.shards[i].clients)
+		}
+		return n
+	}
+
+	// fill the shard of client 0, then a new client of this shard takes the
+	// place of its least recently seen one
+	sh := b.shard(clientKey(clientIP(0)))
+	next := slaveMaxClients
+	newClient := func() int {
+		for ; b.shard(clientKey(clientIP(next))) != sh; next++ {
+		}
+		next++
+		b.pick(clientIP(next - 1))
+		return next - 1
+	}
+	for len(sh.clients) < slaveMaxClients/slaveShards {
+		newClient()
+	}
+	first := b.pick(clientIP(0))
+	oldest := sh.lru.Back().Value.(*slaveAffinity).key
+	added := newClient()
+	if _, ok := sh.clients[oldest]; ok || !remembered(0) || !remembered(added) {
+		t.Error("least recently seen client not forgotten")
+	}
+	if len(sh.clients) != slaveMaxClients/slaveShards {
+		t.Errorf("%d clients in a full shard", len(sh.clients))
+	}
+	if b.pick(clientIP(0)) != first {
+		t.Error("client changed slave in a full table")
+	}
+
+	// without scanning the table
+	start := time.Now()
+	for i := 2 * slaveMaxClients; i < 3*slaveMaxClients; i++ {
+		b.pick(clientIP(i))
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("%d new clients picked in %s", slaveMaxClients, d)
+	}
+	if n := clients(); n > slaveMaxClients {
+		t.Errorf("%d clients remembered", n)
+	}
+}
+
+func TestSlavePickAllocs(t *testing.T) {
+	for _, policy := range []SlavePolicy{SlaveHash, SlaveRoundRobin} {
+		b := newSlaveBalancer(testNodes(3), policy)
+		ip := net.IP{192, 0, 2, 100}
+		b.pick(ip)
+		if allocs := testing.AllocsPerRun(100, func() { b.pick(ip) }); allocs != 0 {
+			t.Errorf("policy %d: %v allocations per pick", policy, allocs)
+		}
+	}
+}
+
+func BenchmarkSlavePick(b *testing.B) {
+	for _, policy := range []SlavePolicy{SlaveHash, SlaveRoundRobin} {
+		bal := newSlaveBalancer(testNodes(3), policy)
+		b.Run([]string{"hash", "round-robin"}[policy], func(b *testing.B) {
+			b.ReportAllocs()
+			b.RunParallel(func(pb *testing.PB) {
+				var i int
+				for pb.Next() {
+					bal.pick(clientIP(i % 1024))
+					i++
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,79 @@
+package server
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+// slaveFuzzSeeds are well-formed and truncated records for the corpus of the
+// slave link decoders, run them with e.g. go test -fuzz FuzzSlaveRecord
+// ./server.
+func slaveFuzzSeeds() [][]byte {
+	seeds := [][]byte{{}}
+	for _, r := range []slaveRecord{
+		{seq: 1, role: typeAP, remote: &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1234}, request: []byte{1, 2, 3}},
+		{seq: 1 << 40, role: typeAA, remote: &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 65535}, key: []byte("0123456789abcdef")},
+	} {
+		b := r.appendTo(nil)
+		seeds = append(seeds, b, b[:11], b[:12], b[:16])
+	}
+	return seeds
+}
+
+func FuzzSlaveRecord(f *testing.F) {
+	for _, seed := range slaveFuzzSeeds() {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var r slaveRecord
+		if err := r.unmarshal(data); err != nil {
+			return
+		}
+		var again slaveRecord
+		if err := again.unmarshal(r.appendTo(nil)); err != nil {
+			t.Fatal("re-encoded record: ", err)
+		}
+		if again.seq != r.seq || again.role != r.role || again.remote.String() != r.remote.String() ||
+			!bytes.Equal(again.key, r.key) || !bytes.Equal(again.request, r.request) {
+			t.Fatalf("got %+v, want %+v", again, r)
+		}
+	})
+}
+
+func FuzzSlaveFrame(f *testing.F) {
+	nonce := make([]byte, slaveNonceSize)
+	for _, secret := range []string{"", "secret"} {
+		w := &slaveFramer{secret: secret, nonce: nonce}
+		for _, seed := range slaveFuzzSeeds() {
+			frame, _ := w.seal(nil, frameRecord, seed)
+			f.Add(frame)
+			f.Add(frame[:len(frame)-1])
+		}
+		hb, _ := w.seal(nil, frameHeartbeat, nil)
+		f.Add(append(hb, hb...))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		for _, secret := range []string{"", "secret"} {
+			// a datagram is a whole frame, a sealed one again
+			framer := &slaveFramer{secret: secret, nonce: nonce}
+			if typ, payload, err := framer.open(data); err == nil {
+				if b, _ := framer.seal(nil, typ, payload); !bytes.Equal(b, data) {
+					t.Fatalf("frame % x sealed again as % x", data, b)
+				}
+			}
+
+			// a stream holds frames up to an error
+			framer = newSlaveFramer(&bufConn{Buffer: bytes.NewBuffer(data)}, secret)
+			framer.nonce = nonce
+			for i := 0; ; i++ {
+				if _, _, err := framer.readFrame(); err != nil {
+					break
+				}
+				if i > len(data)/3 {
+					t.Fatal("more frames than bytes")
+				}
+			}
+		}
+	})
+}
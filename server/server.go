@@ -0,0 +1,440 @@
+// Package server is a STUN server answering Binding requests over UDP, TCP,
+// TLS and DTLS, with the two addresses and ports of RFC 5780 NAT behaviour
+// discovery. The alternate address may be served by a slave server on
+// another machine.
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"github.com/bhpike65/go-stun/stun"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	typePP = iota // primaryAddr:primaryPort
+	typePA        // primaryAddr:alterAddr
+	typeAP        // alterAddr:primaryPort
+	typeAA        // alterAddr:alterAddr
+	typeMax
+)
+
+// slaveDrainTimeout bounds the time spent forwarding the queued requests to
+// the slave when the server is closed.
+const slaveDrainTimeout = 2 * time.Second
+
+var ErrServerClosed = errors.New("stun server closed")
+
+// Logger is where the server reports failures, *log.Logger is one.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+type Config struct {
+	// PrimaryAddr and AltAddr are the two IP addresses of the server. AltAddr
+	// is empty when the alternate address is served by a slave server, or
+	// not at all.
+	PrimaryAddr string
+	AltAddr     string
+	// PrimaryPort and AltPort default to 3478 and 3479.
+	PrimaryPort int
+	AltPort     int
+
+	// SlaveServer is the address of the slave serving the alternate address
+	// of a master, or the address a slave server listens on when Slave is set.
+	// A master may have several slaves in SlaveServers instead, each client
+	// is served by one of them chosen by SlavePolicy.
+	SlaveServer  string
+	SlaveServers []string
+	SlavePolicy  SlavePolicy
+	Slave        bool
+	// SlaveSecret is shared by a master and its slave, it authenticates the
+	// requests forwarded to the slave, which drops the connections of masters
+	// not knowing it. SlaveTLSConfig runs the link over TLS, the master's
+	// config holds its client certificate and the CA of the slave, the
+	// slave's one requires and verifies the client certificate. A link with
+	// neither is refused unless SlaveInsecure is set: anyone reaching the
+	// slave could make it send responses.
+	SlaveSecret    string
+	SlaveTLSConfig *tls.Config
+	SlaveInsecure  bool
+	// SlaveQueue is the number of requests a master queues for each slave,
+	// 128 by default, the oldest one is dropped when the queue is full.
+	// SlaveHeartbeat is the interval of the heartbeats of an idle slave
+	// link, 5s by default, a link silent for three of them is reconnected.
+	SlaveQueue     int
+	SlaveHeartbeat time.Duration
+	// SlaveNetwork is the transport of the slave link, "tcp" by default or
+	// "udp", a datagram per request without head-of-line blocking nor TLS,
+	// the requests lost on the way aren't sent again. The link over udp
+	// requires SlaveSecret.
+	SlaveNetwork string
+
+	// Password enables the short-term credential mechanism, Auth the
+	// long-term one.
+	Password string
+	Auth     *stun.LongTermAuth
+
+	// TCP serves STUN over TCP on PrimaryAddr:PrimaryPort as well.
+	TCP bool
+	// TLSConfig serves STUN over TLS on PrimaryAddr:TLSPort, 5349 by default,
+	// and over DTLS on PrimaryAddr:DTLSPort unless DTLSPort is 0. DTLS uses
+	// the certificates of TLSConfig, DTLSPort requires it.
+	TLSConfig *tls.Config
+	TLSPort   int
+	DTLSPort  int
+	// MaxConns bounds the TCP, TLS and DTLS connections served at once, 1024
+	// by default, the ones beyond are closed as soon as they are accepted.
+	// ConnIdleTimeout closes a connection without any request for a while,
+	// 5 minutes by default.
+	MaxConns        int
+	ConnIdleTimeout time.Duration
+
+	// ReusePort is the number of SO_REUSEPORT sockets per address, Readers
+	// the number of goroutines reading each socket and Batch the number of
+	// packets read and written per system call. They default to 1.
+	ReusePort int
+	Readers   int
+	Batch     int
+
+	// Logger defaults to the standard logger.
+	Logger Logger
+
+	// Authenticate checks the credentials of a request, it returns the error
+	// response to send back when the request is rejected. It defaults to the
+	// mechanism of Password or Auth.
+	Authenticate func(req *stun.StunMessageReq) (*stun.StunMessageResp, error)
+	// OnRequest is called with every decoded request before it is answered,
+	// the request is dropped when it returns false.
+	OnRequest func(remote net.Addr, req *stun.StunMessageReq) bool
+	// OnError is called with the requests which can't be decoded or are
+	// rejected by Authenticate.
+	OnError func(remote net.Addr, err error)
+}
+
+// Server is a STUN server, it is started by Serve and stopped by Close.
+type Server struct {
+	config Config
+	logger Logger
+
+	roleSet   [typeMax]*net.UDPConn
+	roleConns [typeMax][]*net.UDPConn
+	// other is the OTHER-ADDRESS of the responses, the alternate address
+	other *net.UDPAddr
+
+	slaves *slaveBalancer
+	// connSlots holds a token per stream or DTLS connection served,
+	// masterSlots one per connection of a master not authenticated yet
+	connSlots   chan struct{}
+	masterSlots chan struct{}
+
+	mu        sync.Mutex
+	closers   map[io.Closer]struct{}
+	closed    bool
+	done      chan struct{}
+	errc      chan error
+	wg        sync.WaitGroup
+	closeOnce sync.Once
+}
+
+func New(config Config) (*Server, error) {
+	if config.PrimaryPort == 0 {
+		config.PrimaryPort = stun.DefaultPort
+	}
+	if config.AltPort == 0 {
+		config.AltPort = stun.DefaultPort + 1
+	}
+	if config.TLSPort == 0 {
+		config.TLSPort = stun.DefaultTLSPort
+	}
+	if config.MaxConns == 0 {
+		config.MaxConns = 1024
+	}
+	if config.ConnIdleTimeout == 0 {
+		config.ConnIdleTimeout = 5 * time.Minute
+	}
+	if config.SlaveQueue == 0 {
+		config.SlaveQueue = 128
+	}
+	if config.SlaveHeartbeat == 0 {
+		config.SlaveHeartbeat = 5 * time.Second
+	}
+	if config.ReusePort == 0 {
+		config.ReusePort = 1
+	}
+	if config.Readers == 0 {
+		config.Readers = 1
+	}
+	if config.Batch == 0 {
+		config.Batch = 1
+	}
+	if config.ReusePort < 0 || config.Readers < 0 || config.Batch < 0 {
+		return nil, errors.New("reuseport, readers and batch must be at least 1")
+	}
+	if config.MaxConns < 0 || config.ConnIdleTimeout < 0 {
+		return nil, errors.New("max conns and conn idle timeout must be positive")
+	}
+	if config.SlaveQueue < 0 || config.SlaveHeartbeat < 0 {
+		return nil, errors.New("slave queue and heartbeat must be positive")
+	}
+	if config.DTLSPort != 0 && config.TLSConfig == nil {
+		return nil, errors.New("dtls requires a tls config")
+	}
+	switch config.SlaveNetwork {
+	case "":
+		config.SlaveNetwork = "tcp"
+	case "tcp":
+	case "udp":
+		if config.SlaveTLSConfig != nil {
+			return nil, errors.New("the slave link runs over TLS on tcp only")
+		}
+		// a datagram is easily spoofed, even with SlaveInsecure
+		if config.SlaveSecret == "" {
+			return nil, errors.New("the slave link over udp needs a secret")
+		}
+	default:
+		return nil, errors.New("bad slave network " + config.SlaveNetwork)
+	}
+	if net.ParseIP(config.PrimaryAddr) == nil {
+		return nil, errors.New("bad primary address " + config.PrimaryAddr)
+	}
+	if config.AltAddr != "" && net.ParseIP(config.AltAddr) == nil {
+		return nil, errors.New("bad alternative address " + config.AltAddr)
+	}
+	if config.Slave {
+		config.AltAddr = ""
+		config.SlaveServers = nil
+	} else if config.SlaveServer != "" && len(config.SlaveServers) == 0 {
+		config.SlaveServers = []string{config.SlaveServer}
+	}
+	if config.Slave || config.AltAddr == "" && len(config.SlaveServers) > 0 {
+		authenticated := config.SlaveSecret != ""
+		if c := config.SlaveTLSConfig; c != nil {
+			// the slave authenticates the master by its client certificate
+			authenticated = authenticated || !config.Slave || c.ClientAuth == tls.RequireAndVerifyClientCert
+		}
+		if !authenticated && !config.SlaveInsecure {
+			return nil, errors.New("the slave link needs a secret or mutual tls, or to be insecure explicitly")
+		}
+	}
+
+	s := &Server{
+		config:      config,
+		logger:      config.Logger,
+		closers:     make(map[io.Closer]struct{}),
+		connSlots:   make(chan struct{}, config.MaxConns),
+		masterSlots: make(chan struct{}, slaveMaxPending),
+		done:        make(chan struct{}),
+		errc:        make(chan error, 1),
+	}
+	if s.logger == nil {
+		s.logger = log.Default()
+	}
+	if config.AltAddr == "" && len(config.SlaveServers) > 0 {
+		nodes := make([]*slaveNode, len(config.SlaveServers))
+		for i, addr := range config.SlaveServers {
+			slaveAddr, err := net.ResolveTCPAddr("tcp", addr)
+			if err != nil {
+				return nil, errors.New("slave server resolve failed: " + err.Error())
+			}
+			nodes[i] = newSlaveNode(slaveAddr, &s.config)
+		}
+		s.slaves = newSlaveBalancer(nodes, config.SlavePolicy)
+	}
+	return s, nil
+}
+
+// Serve listens on the addresses of the configuration and answers the
+// requests until ctx is done or Close is called. It returns ctx.Err() or
+// ErrServerClosed then, or the error which stopped the server.
+func (s *Server) Serve(ctx context.Context) error {
+	if err := s.start(); err != nil {
+		s.Close()
+		s.wg.Wait()
+		return err
+	}
+
+	var err error
+	select {
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-s.done:
+		err = ErrServerClosed
+	case err = <-s.errc:
+	}
+	s.Close()
+	s.wg.Wait()
+	return err
+}
+
+// Close stops the server, closing its sockets, listeners and connections.
+// The requests queued for the slave server are still forwarded to it, Serve
+// returns once they are.
+func (s *Server) Close() error {
+	s.closeOnce.Do(func() {
+		s.mu.Lock()
+		s.closed = true
+		for c := range s.closers {
+			c.Close()
+		}
+		s.closers = nil
+		if s.slaves != nil {
+			for _, node := range s.slaves.nodes {
+				if node.conn != nil {
+					node.conn.SetWriteDeadline(time.Now().Add(slaveDrainTimeout))
+				}
+			}
+		}
+		s.mu.Unlock()
+		close(s.done)
+	})
+	return nil
+}
+
+// track registers c to be closed by Close, it returns false when the server
+// is already closed, c is closed then.
+func (s *Server) track(c io.Closer) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		c.Close()
+		return false
+	}
+	s.closers[c] = struct{}{}
+	return true
+}
+
+func (s *Server) untrack(c io.Closer) {
+	s.mu.Lock()
+	delete(s.closers, c)
+	s.mu.Unlock()
+}
+
+// fail stops Serve with err.
+func (s *Server) fail(err error) {
+	select {
+	case s.errc <- err:
+	default:
+	}
+}
+
+// goServe runs f in a goroutine Serve waits for.
+func (s *Server) goServe(f func()) {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		f()
+	}()
+}
+
+func (s *Server) start() error {
+	config := &s.config
+	var err error
+
+	if s.roleConns[typePP], err = s.listenRole(&net.UDPAddr{IP: net.ParseIP(config.PrimaryAddr), Port: config.PrimaryPort}); err != nil {
+		return errors.New("listen on PP failed: " + err.Error())
+	}
+	if s.roleConns[typePA], err = s.listenRole(&net.UDPAddr{IP: net.ParseIP(config.PrimaryAddr), Port: config.AltPort}); err != nil {
+		return errors.New("listen on PA failed: " + err.Error())
+	}
+	s.roleSet[typePP], s.roleSet[typePA] = s.roleConns[typePP][0], s.roleConns[typePA][0]
+
+	if config.AltAddr == "" {
+		if config.Slave && config.SlaveServer != "" {
+			slaveAddr, err := net.ResolveTCPAddr("tcp", config.SlaveServer)
+			if err != nil {
+				return errors.New("slave server resolve failed: " + err.Error())
+			}
+			if err = s.startSlave(slaveAddr); err != nil {
+				return err
+			}
+		} else if s.slaves != nil {
+			for _, node := range s.slaves.nodes {
+				node := node
+				s.goServe(func() { s.slaveClientWorker(node) })
+			}
+		}
+	} else {
+		s.other = &net.UDPAddr{IP: net.ParseIP(config.AltAddr), Port: config.AltPort}
+		if s.roleConns[typeAP], err = s.listenRole(&net.UDPAddr{IP: net.ParseIP(config.AltAddr), Port: config.PrimaryPort}); err != nil {
+			return errors.New("listen on AP failed: " + err.Error())
+		}
+		if s.roleConns[typeAA], err = s.listenRole(s.other); err != nil {
+			return errors.New("listen on AA failed: " + err.Error())
+		}
+		s.roleSet[typeAP], s.roleSet[typeAA] = s.roleConns[typeAP][0], s.roleConns[typeAA][0]
+	}
+
+	if config.TCP {
+		l, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.ParseIP(config.PrimaryAddr), Port: config.PrimaryPort})
+		if err != nil {
+			return errors.New("listen on tcp failed: " + err.Error())
+		}
+		s.startStunTCPServer(l)
+	}
+	if config.TLSConfig != nil {
+		l, err := tls.Listen("tcp", net.JoinHostPort(config.PrimaryAddr, strconv.Itoa(config.TLSPort)), config.TLSConfig)
+		if err != nil {
+			return errors.New("listen on tls failed: " + err.Error())
+		}
+		s.startStunTCPServer(l)
+
+		if config.DTLSPort != 0 {
+			if err = s.startStunDTLSServer(); err != nil {
+				return errors.New("listen on dtls failed: " + err.Error())
+			}
+		}
+	}
+
+	for role, conns := range s.roleConns {
+		var other *net.UDPAddr
+		if role == typePP {
+			other = s.other
+		}
+		s.serveRole(role, conns, other)
+	}
+	return nil
+}
+
+// otherAddr is the OTHER-ADDRESS of the responses to the client at ip, the
+// alternate address of the server or of the slave serving the client.
+func (s *Server) otherAddr(ip net.IP) *net.UDPAddr {
+	if s.slaves != nil {
+		return s.slaves.pick(ip).other
+	}
+	return s.other
+}
+
+// authenticate checks the credentials of req, it returns the error response
+// to send back when the request is rejected.
+func (s *Server) authenticate(req *stun.StunMessageReq) (*stun.StunMessageResp, error) {
+	if s.config.Authenticate != nil {
+		return s.config.Authenticate(req)
+	}
+	if s.config.Auth != nil {
+		return s.config.Auth.Authenticate(req)
+	}
+	if s.config.Password != "" {
+		if err := req.CheckShortTermCredentials(s.config.Password); err != nil {
+			code := 401
+			if err == stun.ErrAttributeNotFound {
+				code = 400
+			}
+			return req.NewErrorResponse(code, ""), err
+		}
+	}
+	return nil, nil
+}
+
+// requestError reports a request which can't be decoded or is rejected.
+func (s *Server) requestError(remote net.Addr, err error) {
+	if s.config.OnError != nil {
+		s.config.OnError(remote, err)
+	}
+}
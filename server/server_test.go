@@ -0,0 +1,410 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"github.com/bhpike65/go-stun/stun"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// freePorts returns two UDP ports free on both loopback addresses.
+func freePorts(t testing.TB) (int, int) {
+	var ports []int
+	for len(ports) < 2 {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		port := conn.LocalAddr().(*net.UDPAddr).Port
+		conn.Close()
+		if c, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 2), Port: port}); err == nil {
+			c.Close()
+			ports = append(ports, port)
+		}
+	}
+	return ports[0], ports[1]
+}
+
+// startServer serves config on 127.0.0.1 and 127.0.0.2 until the test ends.
+func startServer(t *testing.T, config Config) *Server {
+	config.PrimaryAddr = "127.0.0.1"
+	config.AltAddr = "127.0.0.2"
+	config.PrimaryPort, config.AltPort = freePorts(t)
+	return runServer(t, config)
+}
+
+// runServer serves config until the test ends, once it answers requests.
+func runServer(t testing.TB, config Config) *Server {
+	config.Logger = log.New(io.Discard, "", 0)
+	s, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	errc := make(chan error, 1)
+	go func() { errc <- s.Serve(context.Background()) }()
+	t.Cleanup(func() {
+		s.Close()
+		if err := <-errc; err != ErrServerClosed {
+			t.Error("serve: ", err)
+		}
+	})
+
+	// wait for the sockets
+	for i := 0; i < 20; i++ {
+		if resp, _ := exchange(t, s, stun.NewBindRequest(nil), 50*time.Millisecond); resp != nil {
+			return s
+		}
+	}
+	t.Fatal("server not answering")
+	return nil
+}
+
+// exchange sends req to the primary address of s and returns the response
+// with its source address, or nil when none arrives within timeout.
+func exchange(t testing.TB, s *Server, req *stun.StunMessageReq, timeout time.Duration) (*stun.StunMessageResp, *net.UDPAddr) {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	server := &net.UDPAddr{IP: net.ParseIP(s.config.PrimaryAddr), Port: s.config.PrimaryPort}
+	if _, err = conn.WriteToUDP(req.Marshal(), server); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	buf := make([]byte, 1500)
+	n, from, err := conn.ReadFromUDP(buf)
+	if err != nil {
+		return nil, nil
+	}
+	var resp stun.StunMessageResp
+	if err = resp.Unmarshal(buf[:n]); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Addr != nil && resp.Addr.String() != conn.LocalAddr().String() {
+		t.Errorf("mapped address %s, want %s", resp.Addr, conn.LocalAddr())
+	}
+	return &resp, from
+}
+
+func TestServeBinding(t *testing.T) {
+	for _, config := range []Config{{}, {ReusePort: 2, Readers: 2, Batch: 8}} {
+		s := startServer(t, config)
+		primary, alt := s.config.PrimaryPort, s.config.AltPort
+
+		cases := []struct {
+			changeIP, changePort bool
+			from                 string
+			port                 int
+		}{
+			{false, false, "127.0.0.1", primary},
+			{false, true, "127.0.0.1", alt},
+			{true, false, "127.0.0.2", primary},
+			{true, true, "127.0.0.2", alt},
+		}
+		for _, c := range cases {
+			req := stun.NewBindRequest(nil)
+			req.SetChangeIP(c.changeIP)
+			req.SetChangePort(c.changePort)
+			resp, from := exchange(t, s, req, time.Second)
+			if resp == nil {
+				t.Fatalf("%+v: no response", c)
+			}
+			if !from.IP.Equal(net.ParseIP(c.from)) || from.Port != c.port {
+				t.Errorf("%+v: response from %s", c, from)
+			}
+		}
+
+		resp, _ := exchange(t, s, stun.NewBindRequest(nil), time.Second)
+		other := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 2), Port: alt}
+		if resp.OtherAddr == nil || resp.OtherAddr.String() != other.String() {
+			t.Errorf("other address %v, want %s", resp.OtherAddr, other)
+		}
+	}
+}
+
+func TestServeHooks(t *testing.T) {
+	var mu sync.Mutex
+	var errs []error
+	s := startServer(t, Config{
+		Password: "secret",
+		OnRequest: func(remote net.Addr, req *stun.StunMessageReq) bool {
+			return req.Username != "blocked"
+		},
+		OnError: func(remote net.Addr, err error) {
+			mu.Lock()
+			errs = append(errs, err)
+			mu.Unlock()
+		},
+	})
+	// forget the request without credentials of startServer
+	mu.Lock()
+	errs = nil
+	mu.Unlock()
+
+	req := stun.NewBindRequest(nil)
+	req.SetShortTermCredentials("blocked", "secret")
+	if resp, _ := exchange(t, s, req, time.Second); resp != nil {
+		t.Error("request not dropped by OnRequest")
+	}
+
+	req = stun.NewBindRequest(nil)
+	req.SetShortTermCredentials("user", "wrong")
+	if resp, _ := exchange(t, s, req, time.Second); resp == nil || resp.ErrorCode != 401 {
+		t.Errorf("wrong password answered with %+v", resp)
+	}
+
+	req = stun.NewBindRequest(nil)
+	req.SetShortTermCredentials("user", "secret")
+	if resp, _ := exchange(t, s, req, time.Second); resp == nil || resp.ErrorCode != 0 || resp.CheckIntegrity([]byte("secret")) != nil {
+		t.Errorf("authenticated request answered with %+v", resp)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(errs) != 1 || errs[0] != stun.ErrIntegrityMismatch {
+		t.Errorf("OnError got %v", errs)
+	}
+}
+
+func TestServeTCP(t *testing.T) {
+	s := startServer(t, Config{TCP: true})
+
+	// the listener is started with the UDP sockets
+	var resp *stun.StunMessageResp
+	var local *net.TCPAddr
+	var err error
+	for i := 0; i < 50; i++ {
+		server := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: s.config.PrimaryPort}
+		if resp, local, err = stun.NewBindRequest(nil).RequestTCP("", server.String()); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Addr.String() != local.String() {
+		t.Errorf("mapped address %s, want %s", resp.Addr, local)
+	}
+
+	// DTLS uses the TLS certificates
+	if _, err = New(Config{PrimaryAddr: "127.0.0.1", DTLSPort: stun.DefaultTLSPort}); err == nil {
+		t.Error("DTLS accepted without a TLS config")
+	}
+}
+
+func TestServeStop(t *testing.T) {
+	primary, alt := freePorts(t)
+	config := Config{PrimaryAddr: "127.0.0.1", PrimaryPort: primary, AltPort: alt, TCP: true, Logger: log.New(io.Discard, "", 0)}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	errc := make(chan error, 1)
+	go func() { errc <- s.Serve(ctx) }()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	select {
+	case err = <-errc:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("serve returned %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("serve still running after cancel")
+	}
+
+	// the addresses are free again
+	s, err = New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { errc <- s.Serve(context.Background()) }()
+	time.Sleep(50 * time.Millisecond)
+	s.Close()
+	if err = <-errc; err != ErrServerClosed {
+		t.Errorf("serve returned %v", err)
+	}
+}
+
+func TestServeSlaveDrain(t *testing.T) {
+	// a slave which records the requests forwarded by the master
+	l, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	records := make(chan int, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			records <- 0
+			return
+		}
+		defer conn.Close()
+		f := newSlaveFramer(conn, "")
+		if err = f.slaveHello(make([]byte, slaveNonceSize)); err != nil {
+			records <- 0
+			return
+		}
+		n := 0
+		for {
+			typ, _, err := f.readFrame()
+			if err != nil {
+				records <- n
+				return
+			}
+			if typ == frameRecord {
+				n++
+			}
+		}
+	}()
+
+	var mu sync.Mutex
+	requests := 0
+	primary, alt := freePorts(t)
+	s, err := New(Config{
+		PrimaryAddr:   "127.0.0.1",
+		PrimaryPort:   primary,
+		AltPort:       alt,
+		SlaveServer:   l.Addr().String(),
+		SlaveInsecure: true,
+		Logger:        log.New(io.Discard, "", 0),
+		OnRequest: func(remote net.Addr, req *stun.StunMessageReq) bool {
+			mu.Lock()
+			requests++
+			mu.Unlock()
+			return true
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	errc := make(chan error, 1)
+	go func() { errc <- s.Serve(context.Background()) }()
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	const count = 20
+	server := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: primary}
+	for i := 0; i < 200; i++ {
+		mu.Lock()
+		n := requests
+		mu.Unlock()
+		if n >= count {
+			break
+		}
+		req := stun.NewBindRequest(nil)
+		req.SetChangeIP(true)
+		conn.WriteToUDP(req.Marshal(), server)
+		time.Sleep(5 * time.Millisecond)
+	}
+	mu.Lock()
+	sent := requests
+	mu.Unlock()
+
+	s.Close()
+	if err = <-errc; err != ErrServerClosed {
+		t.Errorf("serve returned %v", err)
+	}
+	if n := <-records; n != sent {
+		t.Errorf("slave got %d requests, want %d", n, sent)
+	}
+}
+
+func TestServeResponsePort(t *testing.T) {
+	s := startServer(t, Config{})
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+
+	for _, changeIP := range []bool{false, true} {
+		req := stun.NewBindRequest(nil)
+		req.SetChangeIP(changeIP)
+		req.Add(stun.AttrResponsePort, []byte{byte(port >> 8), byte(port), 0, 0})
+		if resp, _ := exchange(t, s, req, 200*time.Millisecond); resp != nil {
+			t.Errorf("change IP %v: response sent to the source", changeIP)
+		}
+
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		buf := make([]byte, 1500)
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			t.Fatalf("change IP %v: no response on RESPONSE-PORT", changeIP)
+		}
+		var resp stun.StunMessageResp
+		if err = resp.Unmarshal(buf[:n]); err != nil {
+			t.Fatal(err)
+		}
+		if resp.Addr.Port == port {
+			t.Errorf("change IP %v: mapped address %s is the RESPONSE-PORT", changeIP, resp.Addr)
+		}
+	}
+}
+
+func TestServeTCPLimits(t *testing.T) {
+	s := startServer(t, Config{TCP: true, MaxConns: 1, ConnIdleTimeout: 200 * time.Millisecond})
+	server := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: s.config.PrimaryPort}
+
+	// closed reports whether the server closes conn within timeout
+	closed := func(conn net.Conn, timeout time.Duration) bool {
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		_, err := conn.Read(make([]byte, 1))
+		return err == io.EOF
+	}
+	dial := func() net.Conn {
+		var conn net.Conn
+		var err error
+		for i := 0; i < 50; i++ {
+			if conn, err = net.DialTCP("tcp", nil, server); err == nil {
+				return conn
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatal(err)
+		return nil
+	}
+
+	first := dial()
+	defer first.Close()
+	if _, err := stun.NewBindRequest(nil).RequestStream(first); err != nil {
+		t.Fatal(err)
+	}
+	// beyond MaxConns
+	second := dial()
+	defer second.Close()
+	if !closed(second, time.Second) {
+		t.Error("connection beyond the limit served")
+	}
+
+	// an idle connection is closed, which frees its slot
+	if !closed(first, time.Second) {
+		t.Fatal("idle connection not closed")
+	}
+	third := dial()
+	defer third.Close()
+	if _, err := stun.NewBindRequest(nil).RequestStream(third); err != nil {
+		t.Errorf("connection after the idle one: %v", err)
+	}
+
+	// a partial message is closed as well
+	third.Write(stun.NewBindRequest(nil).Marshal()[:10])
+	if !closed(third, time.Second) {
+		t.Error("connection stuck in a partial message not closed")
+	}
+}
@@ -0,0 +1,610 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"errors"
+	"github.com/bhpike65/go-stun/stun"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// slaveHandshakeTimeout bounds the TLS handshake and the hellos of the slave
+// link.
+const slaveHandshakeTimeout = 5 * time.Second
+
+// slaveMaxPending bounds the connections a slave accepts from masters which
+// didn't send an authenticated frame yet, the ones beyond are closed, and the
+// UDP hellos of such masters it keeps, the oldest are dropped.
+const slaveMaxPending = 64
+
+// A master reconnects to its slave after slaveMinBackoff, doubled up to
+// slaveMaxBackoff while the slave can't be reached.
+const (
+	slaveMinBackoff = 500 * time.Millisecond
+	slaveMaxBackoff = 30 * time.Second
+)
+
+// slaveRecordTTL is the age after which a request is no more sent to the
+// slave, the client has given up or retransmitted it by then.
+const slaveRecordTTL = 5 * time.Second
+
+// SlaveStats are the counters of the requests a master forwards to one of
+// its slaves.
+type SlaveStats struct {
+	// Addr is the address of the slave, it is Healthy while connected.
+	Addr    string
+	Healthy bool
+	// Forwarded requests were written to the slave, Acked ones answered by
+	// it and Failed ones rejected or not answered by it. Retried requests
+	// were written again after a reconnection as they weren't acked.
+	Forwarded uint64
+	Acked     uint64
+	Failed    uint64
+	Retried   uint64
+	// Dropped requests were pushed out of the full queue, Expired ones
+	// were older than slaveRecordTTL when the slave could take them.
+	Dropped uint64
+	Expired uint64
+	// Reconnects counts the connections to the slave after the first one.
+	Reconnects uint64
+	// RTT is the time between the latest acked record and its ack, Elapsed
+	// the time the slave took to answer it.
+	RTT     time.Duration
+	Elapsed time.Duration
+}
+
+// SlaveStats returns the counters of the requests forwarded to each slave,
+// in the order of the configuration.
+func (s *Server) SlaveStats() []SlaveStats {
+	if s.slaves == nil {
+		return nil
+	}
+	stats := make([]SlaveStats, len(s.slaves.nodes))
+	for i, node := range s.slaves.nodes {
+		node.mu.Lock()
+		stats[i] = node.stats
+		node.mu.Unlock()
+	}
+	return stats
+}
+
+// slaveNode is a slave of a master, with the queue of the requests waiting
+// for it.
+type slaveNode struct {
+	addr *net.TCPAddr
+	// other is the OTHER-ADDRESS of the clients served by the slave
+	other *net.UDPAddr
+	queue *slaveQueue
+	// conn is guarded by the mutex of the server, for Close
+	conn net.Conn
+
+	mu    sync.Mutex
+	stats SlaveStats
+}
+
+func newSlaveNode(addr *net.TCPAddr, config *Config) *slaveNode {
+	return &slaveNode{
+		addr:  addr,
+		other: &net.UDPAddr{IP: addr.IP, Port: config.AltPort},
+		queue: newSlaveQueue(config.SlaveQueue),
+		stats: SlaveStats{Addr: addr.String()},
+	}
+}
+
+func (node *slaveNode) healthy() bool {
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	return node.stats.Healthy
+}
+
+func (node *slaveNode) setHealthy(healthy bool) {
+	node.mu.Lock()
+	node.stats.Healthy = healthy
+	node.mu.Unlock()
+}
+
+// count adds to a counter of the stats.
+func (node *slaveNode) count(counter *uint64, n int) {
+	node.mu.Lock()
+	*counter += uint64(n)
+	node.mu.Unlock()
+}
+
+// slaveQueue is the bounded queue of the requests waiting for a slave, it
+// drops the oldest one when it is full.
+type slaveQueue struct {
+	mu      sync.Mutex
+	records []*slaveRecord
+	head, n int
+	// ready is signalled when a record is pushed
+	ready chan struct{}
+}
+
+func newSlaveQueue(size int) *slaveQueue {
+	return &slaveQueue{records: make([]*slaveRecord, size), ready: make(chan struct{}, 1)}
+}
+
+// push queues r, it returns false when the oldest record was dropped for it.
+func (q *slaveQueue) push(r *slaveRecord) bool {
+	q.mu.Lock()
+	ok := q.n < len(q.records)
+	if ok {
+		q.n++
+	} else {
+		q.head = (q.head + 1) % len(q.records)
+	}
+	q.records[(q.head+q.n-1)%len(q.records)] = r
+	q.mu.Unlock()
+
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+	return ok
+}
+
+// pop returns the oldest record, nil when the queue is empty.
+func (q *slaveQueue) pop() *slaveRecord {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.n == 0 {
+		return nil
+	}
+	r := q.records[q.head]
+	q.records[q.head] = nil
+	q.head = (q.head + 1) % len(q.records)
+	q.n--
+	return r
+}
+
+// slaveLink is the connection of a master to its slave.
+type slaveLink struct {
+	*slaveFramer
+	seq uint64
+	buf []byte
+
+	mu      sync.Mutex
+	pending map[uint64]*slaveRecord
+	// alive is set once the slave sent a frame, dead is closed when the
+	// connection fails
+	alive bool
+	dead  chan struct{}
+}
+
+// write sends r, numbered by the link.
+func (l *slaveLink) write(r *slaveRecord) error {
+	l.seq++
+	r.seq = l.seq
+	r.sent = time.Now()
+	l.mu.Lock()
+	l.pending[r.seq] = r
+	l.mu.Unlock()
+	l.buf = r.appendTo(l.buf[:0])
+	return l.writeFrame(frameRecord, l.buf)
+}
+
+// expire forgets the records sent before ttl and not acked yet, lost when
+// the link is a datagram one, it returns their number.
+func (l *slaveLink) expire(ttl time.Duration) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	n := 0
+	for seq, r := range l.pending {
+		if time.Since(r.sent) > ttl {
+			delete(l.pending, seq)
+			n++
+		}
+	}
+	return n
+}
+
+// unacked returns the records sent on the link and not acked, in order.
+func (l *slaveLink) unacked() []*slaveRecord {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	records := make([]*slaveRecord, 0, len(l.pending))
+	for _, r := range l.pending {
+		records = append(records, r)
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].seq < records[j].seq })
+	return records
+}
+
+// sendToSlave queues a request for a slave without blocking the socket
+// reader, the oldest request is dropped when the queue is full.
+func (s *Server) sendToSlave(node *slaveNode, r *slaveRecord) {
+	if !node.queue.push(r) {
+		node.count(&node.stats.Dropped, 1)
+	}
+}
+
+// dialSlave connects to the slave, over TLS with SlaveTLSConfig or over UDP
+// when SlaveNetwork is udp, and exchanges the hellos.
+func (s *Server) dialSlave(addr *net.TCPAddr) (*slaveLink, error) {
+	if s.config.SlaveNetwork == "udp" {
+		conn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: addr.IP, Port: addr.Port, Zone: addr.Zone})
+		if err != nil {
+			return nil, err
+		}
+		return s.helloSlave(conn, true)
+	}
+	tcpConn, err := net.DialTimeout("tcp", addr.String(), slaveHandshakeTimeout)
+	if err != nil {
+		return nil, err
+	}
+	tcpConn.(*net.TCPConn).SetNoDelay(true)
+	conn := tcpConn
+	conn.SetDeadline(time.Now().Add(slaveHandshakeTimeout))
+	if config := s.config.SlaveTLSConfig; config != nil {
+		if config.ServerName == "" {
+			config = config.Clone()
+			config.ServerName = addr.IP.String()
+		}
+		tlsConn := tls.Client(tcpConn, config)
+		if err = tlsConn.Handshake(); err != nil {
+			tcpConn.Close()
+			return nil, errors.New("tls handshake failed: " + err.Error())
+		}
+		conn = tlsConn
+	}
+	return s.helloSlave(conn, false)
+}
+
+// helloSlave exchanges the hellos on conn, a datagram one when datagram is
+// set.
+func (s *Server) helloSlave(conn net.Conn, datagram bool) (*slaveLink, error) {
+	conn.SetDeadline(time.Now().Add(slaveHandshakeTimeout))
+	link := &slaveLink{
+		slaveFramer: newSlaveFramer(conn, s.config.SlaveSecret),
+		pending:     make(map[uint64]*slaveRecord),
+		dead:        make(chan struct{}),
+	}
+	link.datagram = datagram
+	if err := link.masterHello(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if datagram {
+		// the slave keeps the session once authenticated, before other
+		// hellos push the nonce out
+		if err := link.writeFrame(frameHeartbeat, nil); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	conn.SetDeadline(time.Time{})
+	return link, nil
+}
+
+// slaveClientWorker keeps a connection to a slave and forwards its queued
+// requests on it until the server is closed. A lost connection is redialed
+// with an exponential backoff, the requests it didn't ack are sent again.
+func (s *Server) slaveClientWorker(node *slaveNode) {
+	backoff := slaveMinBackoff
+	var retry []*slaveRecord
+	for connected := false; ; {
+		link, err := s.dialSlave(node.addr)
+		if err != nil {
+			s.logger.Printf("Dial slave server %s failed: %s, retry in %s", node.addr, err.Error(), backoff)
+		} else {
+			if connected {
+				node.count(&node.stats.Reconnects, 1)
+			}
+			connected = true
+			node.setHealthy(true)
+			retry = s.serveSlaveLink(node, link, retry)
+			node.setHealthy(false)
+			if retry == nil && s.isClosed() {
+				return
+			}
+			link.mu.Lock()
+			alive := link.alive
+			link.mu.Unlock()
+			if alive {
+				// the link worked, redial at once
+				backoff = slaveMinBackoff
+				continue
+			}
+		}
+
+		select {
+		case <-time.After(backoff):
+		case <-s.done:
+			return
+		}
+		if backoff *= 2; backoff > slaveMaxBackoff {
+			backoff = slaveMaxBackoff
+		}
+	}
+}
+
+func (s *Server) isClosed() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// serveSlaveLink writes retry and the queued requests of node to link, with
+// heartbeats when it is idle, until it fails or the server is closed. It
+// returns the requests to write again on the next connection.
+func (s *Server) serveSlaveLink(node *slaveNode, link *slaveLink, retry []*slaveRecord) []*slaveRecord {
+	if !s.setSlaveConn(node, link.conn) {
+		link.conn.Close()
+		return nil
+	}
+	s.goServe(func() { s.readSlaveAcks(node, link) })
+	heartbeat := time.NewTicker(s.config.SlaveHeartbeat)
+	defer heartbeat.Stop()
+
+	// fail closes the link, the records it didn't ack are written again on
+	// a stream link
+	fail := func(err error) []*slaveRecord {
+		s.logger.Printf("Write to slave server %s failed: %s", node.addr, err.Error())
+		s.setSlaveConn(node, nil)
+		link.conn.Close()
+		retry := link.unacked()
+		if link.datagram {
+			// lost like the datagrams, the clients retransmit
+			node.count(&node.stats.Failed, len(retry))
+			return nil
+		}
+		node.count(&node.stats.Retried, len(retry))
+		return retry
+	}
+
+	for _, r := range retry {
+		if err := s.writeSlave(node, link, r); err != nil {
+			return fail(err)
+		}
+	}
+	for {
+		select {
+		case <-node.queue.ready:
+			for r := node.queue.pop(); r != nil; r = node.queue.pop() {
+				if err := s.writeSlave(node, link, r); err != nil {
+					return fail(err)
+				}
+			}
+		case <-heartbeat.C:
+			if err := link.writeFrame(frameHeartbeat, nil); err != nil {
+				return fail(err)
+			}
+			if link.datagram {
+				node.count(&node.stats.Failed, link.expire(slaveRecordTTL))
+			}
+		case <-link.dead:
+			return fail(errors.New("connection lost"))
+		case <-s.done:
+			s.drainSlave(node, link)
+			link.conn.Close()
+			return nil
+		}
+	}
+}
+
+// writeSlave writes r to link unless it is too old to be answered.
+func (s *Server) writeSlave(node *slaveNode, link *slaveLink, r *slaveRecord) error {
+	if time.Since(r.queued) > slaveRecordTTL {
+		node.count(&node.stats.Expired, 1)
+		return nil
+	}
+	if err := link.write(r); err != nil {
+		return err
+	}
+	node.count(&node.stats.Forwarded, 1)
+	return nil
+}
+
+// readSlaveAcks counts the acks of the slave until the link fails or is
+// silent for three heartbeats.
+func (s *Server) readSlaveAcks(node *slaveNode, link *slaveLink) {
+	defer close(link.dead)
+	var ack slaveAck
+	for {
+		link.conn.SetReadDeadline(time.Now().Add(3 * s.config.SlaveHeartbeat))
+		typ, payload, err := link.readFrame()
+		if err != nil {
+			if err != io.EOF && !errors.Is(err, net.ErrClosed) {
+				s.logger.Printf("read from slave server %s failed: %s", node.addr, err.Error())
+			}
+			return
+		}
+		link.mu.Lock()
+		link.alive = true
+		link.mu.Unlock()
+		if typ == frameHeartbeat {
+			continue
+		}
+		if typ != frameAck || ack.unmarshal(payload) != nil {
+			s.logger.Printf("receive error slave ack")
+			continue
+		}
+
+		link.mu.Lock()
+		r, ok := link.pending[ack.seq]
+		delete(link.pending, ack.seq)
+		link.mu.Unlock()
+		node.mu.Lock()
+		if ack.status == ackOK {
+			node.stats.Acked++
+		} else {
+			node.stats.Failed++
+		}
+		if ok {
+			node.stats.RTT = time.Since(r.sent)
+		}
+		node.stats.Elapsed = ack.elapsed
+		node.mu.Unlock()
+	}
+}
+
+// setSlaveConn records the connection to a slave, Close bounds the time
+// left to write to it. It returns false when the server is already closed.
+func (s *Server) setSlaveConn(node *slaveNode, conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	node.conn = conn
+	return !s.closed
+}
+
+// drainSlave forwards the requests still queued for a slave when the server
+// is closed, within the write deadline set by Close.
+func (s *Server) drainSlave(node *slaveNode, link *slaveLink) {
+	for r := node.queue.pop(); r != nil; r = node.queue.pop() {
+		if err := s.writeSlave(node, link, r); err != nil {
+			s.logger.Printf("Write to slave server %s failed: %s", node.addr, err.Error())
+			return
+		}
+	}
+}
+
+// startSlave listens for the master server on slaveServer.
+func (s *Server) startSlave(slaveServer *net.TCPAddr) error {
+	if s.config.SlaveNetwork == "udp" {
+		return s.startSlaveUDP(slaveServer)
+	}
+	l, err := net.ListenTCP("tcp", slaveServer)
+	if err != nil {
+		return errors.New("slave tcp listen error: " + err.Error())
+	}
+	s.track(l)
+
+	s.goServe(func() {
+		for {
+			conn, err := l.AcceptTCP()
+			if err != nil {
+				if !errors.Is(err, net.ErrClosed) {
+					s.fail(errors.New("slave accept error: " + err.Error()))
+				}
+				return
+			}
+			select {
+			case s.masterSlots <- struct{}{}:
+			default:
+				conn.Close()
+				continue
+			}
+			s.goServe(func() { s.slaveProcessRequest(conn) })
+		}
+	})
+	return nil
+}
+
+// slaveProcessRequest serves the connection of a master, which holds a slot
+// of masterSlots until its first authenticated frame.
+func (s *Server) slaveProcessRequest(conn net.Conn) {
+	pending := true
+	defer func() {
+		if pending {
+			<-s.masterSlots
+		}
+	}()
+	if !s.track(conn) {
+		return
+	}
+	defer s.untrack(conn)
+	defer conn.Close()
+
+	remote := conn.RemoteAddr()
+	conn.SetDeadline(time.Now().Add(slaveHandshakeTimeout))
+	if s.config.SlaveTLSConfig != nil {
+		tlsConn := tls.Server(conn, s.config.SlaveTLSConfig)
+		if err := tlsConn.Handshake(); err != nil {
+			s.logger.Printf("reject master %s: tls handshake failed %s", remote, err.Error())
+			return
+		}
+		conn = tlsConn
+	}
+	nonce := make([]byte, slaveNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		s.logger.Printf("generate nonce failed: %s", err.Error())
+		return
+	}
+	f := newSlaveFramer(conn, s.config.SlaveSecret)
+	if err := f.slaveHello(nonce); err != nil {
+		s.logger.Printf("reject master %s: %s", remote, err.Error())
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	var seq uint64
+	var r slaveRecord
+	var req stun.StunMessageReq
+	var ack slaveAck
+	buf := make([]byte, 0, 1500)
+	for {
+		// the master sends heartbeats when idle
+		conn.SetReadDeadline(time.Now().Add(3 * s.config.SlaveHeartbeat))
+		typ, payload, err := f.readFrame()
+		if err == io.EOF || errors.Is(err, net.ErrClosed) {
+			break
+		}
+		if err != nil {
+			// an unauthenticated frame ends the connection
+			s.logger.Printf("reject master %s: %s", remote, err.Error())
+			break
+		}
+		if pending {
+			pending = false
+			<-s.masterSlots
+		}
+		if typ == frameHeartbeat {
+			if err = f.writeFrame(frameHeartbeat, nil); err != nil {
+				s.logger.Printf("heartbeat to master %s failed: %s", remote, err.Error())
+				break
+			}
+			continue
+		}
+		if typ != frameRecord {
+			s.logger.Printf("receive unknown slave frame %d", typ)
+			continue
+		}
+		if err = r.unmarshal(payload); err != nil {
+			s.logger.Printf("receive error slave data: %s", err.Error())
+			break
+		}
+		if r.seq != seq+1 {
+			s.logger.Printf("reject master %s: replayed record %d", remote, r.seq)
+			break
+		}
+		seq++
+
+		start := time.Now()
+		ack.seq, ack.status = r.seq, s.slaveRespond(&r, &req, buf)
+		ack.elapsed = time.Since(start)
+		if err = f.writeFrame(frameAck, ack.appendTo(buf[:0])); err != nil {
+			s.logger.Printf("ack to master %s failed: %s", remote, err.Error())
+			break
+		}
+	}
+}
+
+// slaveRespond answers the request of r as the master would from the role
+// of r, it returns the status of the ack.
+func (s *Server) slaveRespond(r *slaveRecord, req *stun.StunMessageReq, buf []byte) byte {
+	if r.role&0x02 == 0 {
+		s.logger.Printf("receive error slave data: role %d is on the master", r.role)
+		return ackBadRecord
+	}
+	if err := req.Unmarshal(r.request); err != nil {
+		s.logger.Printf("receive error slave data: %s", err.Error())
+		return ackBadRecord
+	}
+	if r.key != nil {
+		req.SetIntegrityKey(r.key)
+	}
+	// the primary address of the slave is the alternate address of the master
+	conn := s.roleSet[r.role&^0x02]
+	if _, err := conn.WriteToUDP(req.AppendResponse(buf, r.remote, nil), responseAddr(req, r.remote)); err != nil {
+		s.logger.Printf("respond to %s failed %s", r.remote, err.Error())
+		return ackRespondFailed
+	}
+	return ackOK
+}
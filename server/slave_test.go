@@ -0,0 +1,900 @@
+package server
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"github.com/bhpike65/go-stun/stun"
+	"io"
+	"math/big"
+	"net"
+	"sort"
+	"testing"
+	"time"
+)
+
+// startSlaveMaster serves a slave on 127.0.0.2 and its master on 127.0.0.1,
+// the master config is completed and started unless it is nil.
+func startSlaveMaster(t testing.TB, slave Config, master *Config) (*Server, *Server) {
+	// a free port of the slave network
+	var addr string
+	if slave.SlaveNetwork == "udp" {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 2)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr = conn.LocalAddr().String()
+		conn.Close()
+	} else {
+		l, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 2)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr = l.Addr().String()
+		l.Close()
+	}
+
+	slave.Slave = true
+	slave.SlaveServer = addr
+	slave.PrimaryAddr = "127.0.0.2"
+	slave.PrimaryPort, slave.AltPort = freePorts(t)
+	s := runServer(t, slave)
+	if master == nil {
+		return s, nil
+	}
+
+	master.SlaveServer, master.SlaveNetwork = slave.SlaveServer, slave.SlaveNetwork
+	master.PrimaryAddr = "127.0.0.1"
+	master.PrimaryPort, master.AltPort = slave.PrimaryPort, slave.AltPort
+	return s, runServer(t, *master)
+}
+
+// changeIP sends a CHANGE-REQUEST to the master and reports whether the
+// slave answers it.
+func changeIP(t testing.TB, master, slave *Server) bool {
+	req := stun.NewBindRequest(nil)
+	req.SetChangeIP(true)
+	for i := 0; i < 5; i++ {
+		if resp, from := exchange(t, master, req, 100*time.Millisecond); resp != nil {
+			if !from.IP.Equal(net.ParseIP(slave.config.PrimaryAddr)) {
+				t.Errorf("response from %s", from)
+			}
+			return true
+		}
+	}
+	return false
+}
+
+func TestSlaveSecret(t *testing.T) {
+	slave, master := startSlaveMaster(t, Config{SlaveSecret: "secret"}, &Config{SlaveSecret: "secret"})
+	if !changeIP(t, master, slave) {
+		t.Error("no response from the slave")
+	}
+
+	slave, master = startSlaveMaster(t, Config{SlaveSecret: "secret"}, &Config{SlaveSecret: "wrong"})
+	if changeIP(t, master, slave) {
+		t.Error("slave answered a master with the wrong secret")
+	}
+	slave, master = startSlaveMaster(t, Config{SlaveSecret: "secret"}, &Config{SlaveInsecure: true})
+	if changeIP(t, master, slave) {
+		t.Error("slave answered a master without secret")
+	}
+
+	// a link without secret nor mutual TLS is insecure explicitly
+	for _, c := range []Config{
+		{SlaveServer: "127.0.0.2:3480"},
+		{SlaveServer: "127.0.0.2:3480", Slave: true},
+		{SlaveServer: "127.0.0.2:3480", Slave: true, SlaveTLSConfig: &tls.Config{}},
+	} {
+		c.PrimaryAddr = "127.0.0.1"
+		if _, err := New(c); err == nil {
+			t.Errorf("slave link accepted without authentication: %+v", c)
+		}
+		c.SlaveInsecure = true
+		if _, err := New(c); err != nil {
+			t.Errorf("insecure slave link: %v", err)
+		}
+	}
+}
+
+func TestSlavePending(t *testing.T) {
+	slave, _ := startSlaveMaster(t, Config{SlaveSecret: "secret"}, nil)
+	slaveAddr, _ := net.ResolveTCPAddr("tcp", slave.config.SlaveServer)
+	dial := func() net.Conn {
+		var conn net.Conn
+		var err error
+		for i := 0; i < 50; i++ {
+			if conn, err = net.DialTCP("tcp", nil, slaveAddr); err == nil {
+				return conn
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatal(err)
+		return nil
+	}
+
+	// connections which never authenticate
+	idle := make([]net.Conn, slaveMaxPending)
+	for i := range idle {
+		idle[i] = dial()
+		defer idle[i].Close()
+	}
+	conn := dial()
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("connection beyond the pending ones: %v, want EOF", err)
+	}
+
+	// their slots are freed as they go
+	idle[0].Close()
+	time.Sleep(100 * time.Millisecond)
+	link, err := (&Server{config: Config{SlaveSecret: "secret"}}).dialSlave(slaveAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer link.conn.Close()
+	if err = link.writeFrame(frameHeartbeat, nil); err != nil {
+		t.Fatal(err)
+	}
+	link.conn.SetReadDeadline(time.Now().Add(time.Second))
+	if typ, _, err := link.readFrame(); err != nil || typ != frameHeartbeat {
+		t.Fatalf("heartbeat %d %v", typ, err)
+	}
+	// and an authenticated master doesn't hold one
+	conn = dial()
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if _, err := conn.Read(make([]byte, 1)); err == io.EOF {
+		t.Error("connection closed while a slot is free")
+	}
+}
+
+func TestSlaveReplay(t *testing.T) {
+	slave, _ := startSlaveMaster(t, Config{SlaveSecret: "secret"}, nil)
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	record := &slaveRecord{
+		role:    typeAP,
+		remote:  client.LocalAddr().(*net.UDPAddr),
+		request: stun.NewBindRequest(nil).Marshal(),
+	}
+
+	// answered reports whether the slave sends a response to client
+	answered := func() bool {
+		client.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		_, _, err := client.ReadFromUDP(make([]byte, 1500))
+		return err == nil
+	}
+	dial := func(secret string) *slaveLink {
+		slaveAddr, _ := net.ResolveTCPAddr("tcp", slave.config.SlaveServer)
+		link, err := (&Server{config: Config{SlaveSecret: secret}}).dialSlave(slaveAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { link.conn.Close() })
+		return link
+	}
+
+	link := dial("secret")
+	if err = link.write(record); err != nil || !answered() {
+		t.Fatal("signed record not answered", err)
+	}
+	typ, payload, err := link.readFrame()
+	var ack slaveAck
+	if err != nil || typ != frameAck || ack.unmarshal(payload) != nil || ack.seq != 1 || ack.status != ackOK {
+		t.Errorf("ack %d %+v %v", typ, ack, err)
+	}
+	// the same sequence number again
+	link.seq--
+	link.write(record)
+	if answered() {
+		t.Error("replayed record answered")
+	}
+
+	// a record of another connection
+	old := link.nonce
+	link = dial("secret")
+	link.nonce = old
+	link.write(record)
+	if answered() {
+		t.Error("record of another connection answered")
+	}
+
+	// a peer without the secret
+	link = dial("wrong")
+	link.write(record)
+	if answered() {
+		t.Error("forged record answered")
+	}
+	if _, err = link.conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("connection of an unauthenticated peer not closed: %v", err)
+	}
+}
+
+// testCertificate is a self-signed certificate of 127.0.0.2 for both ends of
+// the slave link.
+func testCertificate(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 2)},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+func TestSlaveTLS(t *testing.T) {
+	cert, pool := testCertificate(t)
+	slaveConfig := Config{SlaveTLSConfig: &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+	}}
+
+	_, master := startSlaveMaster(t, slaveConfig, &Config{Password: "secret", SlaveTLSConfig: &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      pool,
+	}})
+	// the slave signs the response with the key of the request
+	req := stun.NewBindRequest(nil)
+	req.SetShortTermCredentials("user", "secret")
+	req.SetChangeIP(true)
+	resp, from := exchange(t, master, req, time.Second)
+	if resp == nil || !from.IP.Equal(net.IPv4(127, 0, 0, 2)) {
+		t.Fatalf("response %+v from %s", resp, from)
+	}
+	if err := resp.CheckIntegrity([]byte("secret")); err != nil {
+		t.Error("response of the slave: ", err)
+	}
+
+	// a master without certificate keeps redialing the slave
+	slave, master := startSlaveMaster(t, slaveConfig, &Config{SlaveTLSConfig: &tls.Config{RootCAs: pool}})
+	if changeIP(t, master, slave) {
+		t.Error("slave answered a master without certificate")
+	}
+	if stats := master.SlaveStats()[0]; stats.Forwarded != 0 {
+		t.Errorf("stats %+v", stats)
+	}
+}
+
+func TestSlaveRecord(t *testing.T) {
+	for _, r := range []slaveRecord{
+		{seq: 1, role: typeAP, remote: &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1234}, request: []byte{1, 2, 3}},
+		{seq: 1 << 40, role: typeAA, remote: &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 65535}, key: []byte("0123456789abcdef")},
+	} {
+		var got slaveRecord
+		if err := got.unmarshal(r.appendTo(nil)); err != nil {
+			t.Fatal(err)
+		}
+		if got.seq != r.seq || got.role != r.role || got.remote.String() != r.remote.String() ||
+			!bytes.Equal(got.key, r.key) || !bytes.Equal(got.request, r.request) {
+			t.Errorf("got %+v, want %+v", got, r)
+		}
+	}
+
+	ack := slaveAck{seq: 7, status: ackRespondFailed, elapsed: 1500 * time.Microsecond}
+	var got slaveAck
+	if err := got.unmarshal(ack.appendTo(nil)); err != nil || got != ack {
+		t.Errorf("got %+v, want %+v: %v", got, ack, err)
+	}
+}
+
+func TestSlaveFrame(t *testing.T) {
+	var b bytes.Buffer
+	conn := &bufConn{Buffer: &b}
+	nonce := make([]byte, slaveNonceSize)
+	w := &slaveFramer{conn: conn, secret: "secret", nonce: nonce}
+	if err := w.writeFrame(frameRecord, []byte("payload")); err != nil {
+		t.Fatal(err)
+	}
+	frame := append([]byte(nil), b.Bytes()...)
+
+	r := newSlaveFramer(conn, "secret")
+	r.nonce = nonce
+	if typ, payload, err := r.readFrame(); err != nil || typ != frameRecord || string(payload) != "payload" {
+		t.Errorf("readFrame = %d, %q, %v", typ, payload, err)
+	}
+	for i := range frame {
+		tampered := append([]byte(nil), frame...)
+		tampered[i] ^= 0x01
+		b.Write(tampered)
+		r := newSlaveFramer(conn, "secret")
+		r.nonce = nonce
+		if _, _, err := r.readFrame(); err == nil {
+			t.Errorf("frame with byte %d flipped accepted", i)
+		}
+		b.Reset()
+	}
+}
+
+// bufConn is a net.Conn reading and writing a buffer.
+type bufConn struct {
+	net.Conn
+	*bytes.Buffer
+}
+
+func (c *bufConn) Read(b []byte) (int, error)  { return c.Buffer.Read(b) }
+func (c *bufConn) Write(b []byte) (int, error) { return c.Buffer.Write(b) }
+
+func TestSlaveChangePort(t *testing.T) {
+	slave, master := startSlaveMaster(t, Config{SlaveSecret: "secret"}, &Config{SlaveSecret: "secret"})
+	cases := []struct {
+		changeIP, changePort bool
+		from                 string
+		port                 int
+	}{
+		{false, true, "127.0.0.1", master.config.AltPort},
+		{true, false, "127.0.0.2", slave.config.PrimaryPort},
+		{true, true, "127.0.0.2", slave.config.AltPort},
+	}
+	for _, c := range cases {
+		req := stun.NewBindRequest(nil)
+		req.SetChangeIP(c.changeIP)
+		req.SetChangePort(c.changePort)
+		resp, from := exchange(t, master, req, time.Second)
+		if resp == nil {
+			t.Fatalf("%+v: no response", c)
+		}
+		if !from.IP.Equal(net.ParseIP(c.from)) || from.Port != c.port {
+			t.Errorf("%+v: response from %s", c, from)
+		}
+	}
+
+	stats := master.SlaveStats()[0]
+	for i := 0; i < 50 && stats.Acked < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+		stats = master.SlaveStats()[0]
+	}
+	if stats.Forwarded != 2 || stats.Acked != 2 || stats.Failed != 0 || stats.RTT == 0 {
+		t.Errorf("stats %+v", stats)
+	}
+}
+
+func TestSlaveQueue(t *testing.T) {
+	q := newSlaveQueue(3)
+	for i := 1; i <= 5; i++ {
+		if ok := q.push(&slaveRecord{seq: uint64(i)}); ok != (i <= 3) {
+			t.Errorf("push %d = %v", i, ok)
+		}
+	}
+	for i := 3; i <= 5; i++ {
+		if r := q.pop(); r == nil || r.seq != uint64(i) {
+			t.Errorf("pop %+v, want %d", r, i)
+		}
+	}
+	if r := q.pop(); r != nil {
+		t.Errorf("pop %+v from empty queue", r)
+	}
+}
+
+// fakeSlave accepts the connections of a master on 127.0.0.2 and hands them
+// to handle after the hellos, with their number.
+func fakeSlave(t *testing.T, handle func(n int, f *slaveFramer)) string {
+	l, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 2)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for n := 0; ; n++ {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			f := newSlaveFramer(conn, "")
+			if err = f.slaveHello(make([]byte, slaveNonceSize)); err != nil {
+				t.Error(err)
+			}
+			go func(n int) {
+				defer conn.Close()
+				handle(n, f)
+			}(n)
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestSlaveReconnect(t *testing.T) {
+	l, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 2)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+	primary, alt := freePorts(t)
+	slaveConfig := Config{
+		Slave:          true,
+		SlaveServer:    l.Addr().String(),
+		PrimaryAddr:    "127.0.0.2",
+		PrimaryPort:    primary,
+		AltPort:        alt,
+		SlaveSecret:    "secret",
+		SlaveHeartbeat: 50 * time.Millisecond,
+	}
+
+	// the master starts before its slave
+	master := runServer(t, Config{
+		PrimaryAddr:    "127.0.0.1",
+		PrimaryPort:    primary,
+		AltPort:        alt,
+		SlaveServer:    slaveConfig.SlaveServer,
+		SlaveSecret:    "secret",
+		SlaveHeartbeat: 50 * time.Millisecond,
+	})
+	slave := runServer(t, slaveConfig)
+	answered := func() bool {
+		for i := 0; i < 10; i++ {
+			if changeIP(t, master, slave) {
+				return true
+			}
+		}
+		return false
+	}
+	if !answered() {
+		t.Fatal("no response once the slave is up")
+	}
+
+	// and goes on with a restarted slave
+	slave.Close()
+	time.Sleep(200 * time.Millisecond)
+	slave = runServer(t, slaveConfig)
+	if !answered() {
+		t.Fatal("no response from the restarted slave")
+	}
+	if stats := master.SlaveStats()[0]; stats.Reconnects == 0 {
+		t.Errorf("stats %+v", stats)
+	}
+}
+
+func TestSlaveHeartbeat(t *testing.T) {
+	conns := make(chan int, 10)
+	addr := fakeSlave(t, func(n int, f *slaveFramer) {
+		// a slave which hangs, without echoing the heartbeats
+		conns <- n
+		io.Copy(io.Discard, f.conn)
+	})
+	primary, alt := freePorts(t)
+	runServer(t, Config{
+		PrimaryAddr:    "127.0.0.1",
+		PrimaryPort:    primary,
+		AltPort:        alt,
+		SlaveServer:    addr,
+		SlaveInsecure:  true,
+		SlaveHeartbeat: 20 * time.Millisecond,
+	})
+	for i := 0; i < 2; i++ {
+		select {
+		case <-conns:
+		case <-time.After(3 * time.Second):
+			t.Fatal("master didn't reconnect to a silent slave")
+		}
+	}
+}
+
+func TestSlaveRetry(t *testing.T) {
+	records := make(chan *slaveRecord, 10)
+	addr := fakeSlave(t, func(n int, f *slaveFramer) {
+		for {
+			typ, payload, err := f.readFrame()
+			if err != nil {
+				return
+			}
+			if typ == frameHeartbeat {
+				f.writeFrame(frameHeartbeat, nil)
+				continue
+			}
+			r := &slaveRecord{}
+			if err = r.unmarshal(payload); err != nil {
+				t.Error(err)
+				return
+			}
+			r.request = append([]byte(nil), r.request...)
+			records <- r
+			if n == 0 {
+				// the first connection fails before acking its record
+				return
+			}
+			ack := slaveAck{seq: r.seq}
+			f.writeFrame(frameAck, ack.appendTo(nil))
+		}
+	})
+	primary, alt := freePorts(t)
+	master := runServer(t, Config{
+		PrimaryAddr:    "127.0.0.1",
+		PrimaryPort:    primary,
+		AltPort:        alt,
+		SlaveServer:    addr,
+		SlaveInsecure:  true,
+		SlaveHeartbeat: 20 * time.Millisecond,
+	})
+
+	req := stun.NewBindRequest(nil)
+	req.SetChangeIP(true)
+	exchange(t, master, req, 10*time.Millisecond)
+	var got [2]*slaveRecord
+	for i := range got {
+		select {
+		case got[i] = <-records:
+		case <-time.After(3 * time.Second):
+			t.Fatal("request not forwarded again")
+		}
+	}
+	if !bytes.Equal(got[0].request, got[1].request) || got[1].seq != 1 {
+		t.Errorf("forwarded %+v then %+v", got[0], got[1])
+	}
+	stats := master.SlaveStats()[0]
+	for i := 0; i < 50 && stats.Acked == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+		stats = master.SlaveStats()[0]
+	}
+	if stats.Forwarded != 2 || stats.Retried != 1 || stats.Acked != 1 || stats.Reconnects != 1 {
+		t.Errorf("stats %+v", stats)
+	}
+}
+
+func TestSlaveFailover(t *testing.T) {
+	primary, alt := freePorts(t)
+	var slaves []*Server
+	var addrs []string
+	for _, ip := range []net.IP{net.IPv4(127, 0, 0, 2), net.IPv4(127, 0, 0, 3)} {
+		l, err := net.ListenTCP("tcp", &net.TCPAddr{IP: ip})
+		if err != nil {
+			t.Fatal(err)
+		}
+		l.Close()
+		slaves = append(slaves, runServer(t, Config{
+			Slave:       true,
+			SlaveServer: l.Addr().String(),
+			SlaveSecret: "secret",
+			PrimaryAddr: ip.String(),
+			PrimaryPort: primary,
+			AltPort:     alt,
+		}))
+		addrs = append(addrs, l.Addr().String())
+	}
+	master := runServer(t, Config{
+		PrimaryAddr:    "127.0.0.1",
+		PrimaryPort:    primary,
+		AltPort:        alt,
+		SlaveServers:   addrs,
+		SlaveSecret:    "secret",
+		SlaveHeartbeat: 50 * time.Millisecond,
+	})
+
+	// the slaves connect to the master
+	for i := 0; ; i++ {
+		stats := master.SlaveStats()
+		if stats[0].Healthy && stats[1].Healthy {
+			break
+		}
+		if i == 100 {
+			t.Fatalf("stats %+v", stats)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// slaveOf returns the slave advertised to the client once it answers
+	// the CHANGE-REQUEST
+	slaveOf := func() *Server {
+		for i := 0; i < 50; i++ {
+			resp, _ := exchange(t, master, stun.NewBindRequest(nil), time.Second)
+			if resp == nil || resp.OtherAddr == nil {
+				t.Fatalf("response %+v", resp)
+			}
+			other := resp.OtherAddr
+			req := stun.NewBindRequest(nil)
+			req.SetChangeIP(true)
+			if resp, from := exchange(t, master, req, 100*time.Millisecond); resp != nil && from.IP.Equal(other.IP) {
+				for _, slave := range slaves {
+					if from.IP.Equal(net.ParseIP(slave.config.PrimaryAddr)) {
+						return slave
+					}
+				}
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		t.Fatal("the advertised slave doesn't answer")
+		return nil
+	}
+	first := slaveOf()
+	first.Close()
+	if second := slaveOf(); second == first {
+		t.Error("no failover")
+	}
+
+	stats := master.SlaveStats()
+	if len(stats) != 2 || stats[0].Addr != addrs[0] || stats[1].Addr != addrs[1] {
+		t.Errorf("stats %+v", stats)
+	}
+	healthy := 0
+	for _, s := range stats {
+		if s.Healthy {
+			healthy++
+		}
+	}
+	if healthy != 1 {
+		t.Errorf("stats %+v", stats)
+	}
+}
+
+func TestSlaveWindow(t *testing.T) {
+	var w slaveWindow
+	for _, c := range []struct {
+		seq uint64
+		ok  bool
+	}{
+		{0, false}, {1, true}, {1, false}, {3, true}, {2, true}, {2, false},
+		{70, true}, {6, false}, {7, true}, {7, false}, {69, true}, {200, true}, {70, false},
+	} {
+		if ok := w.accept(c.seq); ok != c.ok {
+			t.Errorf("accept %d: %v, want %v", c.seq, ok, c.ok)
+		}
+	}
+}
+
+func TestSlaveUDP(t *testing.T) {
+	slave, master := startSlaveMaster(t, Config{SlaveNetwork: "udp", SlaveSecret: "secret"}, &Config{SlaveSecret: "secret"})
+	if !changeIP(t, master, slave) {
+		t.Fatal("no response from the slave")
+	}
+	if stats := master.SlaveStats()[0]; !stats.Healthy || stats.Forwarded == 0 || stats.Acked == 0 {
+		t.Errorf("stats %+v", stats)
+	}
+
+	slave, master = startSlaveMaster(t, Config{SlaveNetwork: "udp", SlaveSecret: "secret"}, &Config{SlaveSecret: "wrong"})
+	if changeIP(t, master, slave) {
+		t.Error("slave answered a master with the wrong secret")
+	}
+
+	if _, err := New(Config{PrimaryAddr: "127.0.0.1", SlaveNetwork: "udp", SlaveTLSConfig: &tls.Config{}}); err == nil {
+		t.Error("TLS accepted over UDP")
+	}
+	if _, err := New(Config{PrimaryAddr: "127.0.0.1", Slave: true, SlaveServer: "127.0.0.2:3480", SlaveNetwork: "udp", SlaveInsecure: true}); err == nil {
+		t.Error("slave link over UDP accepted without secret")
+	}
+}
+
+// readAck returns the next frame of link but the heartbeats, the slave
+// echoes the one sent after the hello.
+func readAck(link *slaveLink) (byte, []byte, error) {
+	for {
+		typ, payload, err := link.readFrame()
+		if err != nil || typ != frameHeartbeat {
+			return typ, payload, err
+		}
+	}
+}
+
+func TestSlaveUDPReplay(t *testing.T) {
+	slave, _ := startSlaveMaster(t, Config{SlaveNetwork: "udp", SlaveSecret: "secret"}, nil)
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	record := &slaveRecord{
+		role:    typeAP,
+		remote:  client.LocalAddr().(*net.UDPAddr),
+		request: stun.NewBindRequest(nil).Marshal(),
+	}
+	answered := func() bool {
+		client.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		_, _, err := client.ReadFromUDP(make([]byte, 1500))
+		return err == nil
+	}
+
+	slaveAddr, _ := net.ResolveTCPAddr("tcp", slave.config.SlaveServer)
+	link, err := (&Server{config: Config{SlaveNetwork: "udp", SlaveSecret: "secret"}}).dialSlave(slaveAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer link.conn.Close()
+	link.seq = 5
+	if err = link.write(record); err != nil || !answered() {
+		t.Fatal("signed record not answered", err)
+	}
+	link.conn.SetReadDeadline(time.Now().Add(time.Second))
+	typ, payload, err := readAck(link)
+	var ack slaveAck
+	if err != nil || typ != frameAck || ack.unmarshal(payload) != nil || ack.seq != 6 || ack.status != ackOK {
+		t.Errorf("ack %d %+v %v", typ, ack, err)
+	}
+
+	// an older record arriving late is answered once
+	link.seq = 2
+	link.write(record)
+	if !answered() {
+		t.Error("reordered record not answered")
+	}
+	link.seq = 2
+	link.write(record)
+	if answered() {
+		t.Error("replayed record answered")
+	}
+
+	// a forged record
+	link.secret = "wrong"
+	link.write(record)
+	if answered() {
+		t.Error("forged record answered")
+	}
+}
+
+func TestSlaveUDPHello(t *testing.T) {
+	slave, _ := startSlaveMaster(t, Config{SlaveNetwork: "udp", SlaveSecret: "secret"}, nil)
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	record := &slaveRecord{
+		role:    typeAP,
+		remote:  client.LocalAddr().(*net.UDPAddr),
+		request: stun.NewBindRequest(nil).Marshal(),
+	}
+	var link *slaveLink
+	// answered reports whether the slave answers the client and acks the
+	// record
+	answered := func() bool {
+		client.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		if _, _, err := client.ReadFromUDP(make([]byte, 1500)); err != nil {
+			return false
+		}
+		link.conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		typ, _, err := readAck(link)
+		return err == nil && typ == frameAck
+	}
+
+	slaveAddr, _ := net.ResolveTCPAddr("tcp", slave.config.SlaveServer)
+	link, err = (&Server{config: Config{SlaveNetwork: "udp", SlaveSecret: "secret"}}).dialSlave(slaveAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer link.conn.Close()
+	if err = link.write(record); err != nil || !answered() {
+		t.Fatal("signed record not answered", err)
+	}
+
+	// a hello spoofing the address of the master doesn't break its session
+	hello := make([]byte, len(slaveMagic)+1+slaveNonceSize)
+	copy(hello, slaveMagic)
+	hello[len(slaveMagic)] = slaveVersion
+	link.conn.Write(hello)
+	link.conn.SetReadDeadline(time.Now().Add(time.Second))
+	if err = link.readHello(hello); err != nil {
+		t.Fatal("hello not answered: ", err)
+	}
+	if link.write(record); !answered() {
+		t.Error("record not answered after a spoofed hello")
+	}
+
+	// the master restarted, its new session replaces the old one on its
+	// first record
+	old := link.nonce
+	link.conn.SetReadDeadline(time.Now().Add(time.Second))
+	if err = link.masterHello(); err != nil {
+		t.Fatal(err)
+	}
+	link.seq = 0
+	if link.write(record); !answered() {
+		t.Error("record of the new session not answered")
+	}
+	link.nonce = old
+	if link.write(record); answered() {
+		t.Error("record of the old session answered")
+	}
+}
+
+func TestSlaveUDPHelloFlood(t *testing.T) {
+	slave, _ := startSlaveMaster(t, Config{SlaveNetwork: "udp", SlaveSecret: "secret"}, nil)
+	slaveAddr, _ := net.ResolveTCPAddr("tcp", slave.config.SlaveServer)
+	master := &Server{config: Config{SlaveNetwork: "udp", SlaveSecret: "secret", SlaveHeartbeat: time.Second}}
+
+	// a master and the hellos of more masters than a slave serves, which
+	// never authenticate
+	live, err := master.dialSlave(slaveAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer live.conn.Close()
+	hello := make([]byte, len(slaveMagic)+1+slaveNonceSize)
+	copy(hello, slaveMagic)
+	hello[len(slaveMagic)] = slaveVersion
+	for i := 0; i < 2*slaveMaxSessions; i++ {
+		conn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: slaveAddr.IP, Port: slaveAddr.Port})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// answered, so that the socket of the slave doesn't drop the hellos
+		conn.Write(hello)
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		_, err = conn.Read(make([]byte, len(hello)))
+		conn.Close()
+		if err != nil {
+			t.Fatal("hello not answered: ", err)
+		}
+	}
+
+	// the master keeps its session and a new one gets its own
+	late, err := master.dialSlave(slaveAddr)
+	if err != nil {
+		t.Fatal("dial after the flood: ", err)
+	}
+	defer late.conn.Close()
+	for _, link := range []*slaveLink{live, late} {
+		if err = link.writeFrame(frameHeartbeat, nil); err != nil {
+			t.Fatal(err)
+		}
+		link.conn.SetReadDeadline(time.Now().Add(time.Second))
+		// the echoes of the heartbeat sent after the hello and of this one
+		for i := 0; i < 2; i++ {
+			if typ, _, err := link.readFrame(); err != nil || typ != frameHeartbeat {
+				t.Fatalf("heartbeat not echoed: %d %v", typ, err)
+			}
+		}
+	}
+}
+
+// BenchmarkSlaveForward measures the latency of the CHANGE-REQUESTs answered
+// by the slave over each slave network, the percentiles are reported in µs.
+func BenchmarkSlaveForward(b *testing.B) {
+	for _, network := range []string{"tcp", "udp"} {
+		b.Run(network, func(b *testing.B) {
+			_, master := startSlaveMaster(b, Config{SlaveNetwork: network, SlaveSecret: "secret"}, &Config{SlaveSecret: "secret"})
+			conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer conn.Close()
+			server := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: master.config.PrimaryPort}
+			req := stun.NewBindRequest(nil)
+			req.SetChangeIP(true)
+			msg := req.Marshal()
+			buf := make([]byte, 1500)
+
+			latencies := make([]time.Duration, 0, b.N)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				start := time.Now()
+				for {
+					if _, err = conn.WriteToUDP(msg, server); err != nil {
+						b.Fatal(err)
+					}
+					conn.SetReadDeadline(time.Now().Add(time.Second))
+					if _, _, err = conn.ReadFromUDP(buf); err == nil {
+						break
+					}
+				}
+				latencies = append(latencies, time.Since(start))
+			}
+			b.StopTimer()
+			sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+			b.ReportMetric(float64(latencies[len(latencies)/2].Microseconds()), "p50-µs")
+			b.ReportMetric(float64(latencies[len(latencies)*99/100].Microseconds()), "p99-µs")
+		})
+	}
+}
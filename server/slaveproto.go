@@ -0,0 +1,346 @@
+package server
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// The master forwards the requests which must be answered from the
+// alternate address to the slave over TCP, optionally over TLS. The master
+// starts a connection with a hello, "STNS" and the protocol version, the
+// slave answers with its hello, "STNS", its version and a random nonce.
+// Then every message is a frame:
+//
+//	type (1) | length (2) | payload (length) | mac (32, with a secret)
+//
+// The mac is the HMAC-SHA256 of the nonce, the type, the length and the
+// payload. The master sends a record per request:
+//
+//	seq (8) | role (1) | port (2) | ip length (1) | ip | key length (1) | key | request
+//
+// seq starts at 1 on every connection, role is the role of the master the
+// response comes from, port and ip the source of the request, key the
+// MESSAGE-INTEGRITY key of an authenticated request, only sent over TLS,
+// and request the request as received. The slave answers every record with
+// an ack:
+//
+//	seq (8) | status (1) | elapsed microseconds (4)
+//
+// An idle master sends empty heartbeat frames, which the slave echoes, both
+// ends close a connection silent for three heartbeats.
+//
+// Over UDP every hello and frame is a datagram. The master pads its hello to
+// the size of the hello of the slave, so that a slave can't be used to
+// amplify spoofed datagrams, and the hello of the slave starts a session
+// for the address of the master. The records may be lost or reordered: the
+// slave answers every sequence number once, within the last 64, and the
+// lost records are not sent again, the client retransmits its request.
+
+const (
+	slaveMagic   = "STNS"
+	slaveVersion = 1
+
+	slaveNonceSize = 16
+	slaveMACSize   = sha256.Size
+	// slaveMaxDatagram is the size of the largest frame
+	slaveMaxDatagram = 3 + 0xffff + slaveMACSize
+
+	frameRecord    = 1
+	frameAck       = 2
+	frameHeartbeat = 3
+
+	// status of an ack
+	ackOK            = 0
+	ackBadRecord     = 1
+	ackRespondFailed = 2
+)
+
+var errSlaveAuth = errors.New("unauthenticated slave frame")
+
+// slaveRecord is a request forwarded to the slave.
+type slaveRecord struct {
+	seq     uint64
+	role    int
+	remote  *net.UDPAddr
+	key     []byte
+	request []byte
+
+	// queued is when the master received the request, sent when it was
+	// last written to the slave
+	queued time.Time
+	sent   time.Time
+}
+
+func (r *slaveRecord) appendTo(b []byte) []byte {
+	ip := r.remote.IP
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	b = binary.BigEndian.AppendUint64(b, r.seq)
+	b = append(b, byte(r.role))
+	b = binary.BigEndian.AppendUint16(b, uint16(r.remote.Port))
+	b = append(b, byte(len(ip)))
+	b = append(b, ip...)
+	b = append(b, byte(len(r.key)))
+	b = append(b, r.key...)
+	return append(b, r.request...)
+}
+
+func (r *slaveRecord) unmarshal(b []byte) error {
+	if len(b) < 12 {
+		return io.ErrUnexpectedEOF
+	}
+	r.seq = binary.BigEndian.Uint64(b)
+	r.role = int(b[8])
+	port := int(binary.BigEndian.Uint16(b[9:]))
+	n := int(b[11])
+	b = b[12:]
+	if (n != net.IPv4len && n != net.IPv6len) || len(b) < n+1 {
+		return errors.New("bad address in slave record")
+	}
+	r.remote = &net.UDPAddr{IP: net.IP(b[:n:n]), Port: port}
+	b = b[n:]
+	n = int(b[0])
+	b = b[1:]
+	if len(b) < n {
+		return io.ErrUnexpectedEOF
+	}
+	r.key = nil
+	if n > 0 {
+		r.key = b[:n:n]
+	}
+	r.request = b[n:]
+	if r.role < 0 || r.role >= typeMax {
+		return fmt.Errorf("bad role %d in slave record", r.role)
+	}
+	return nil
+}
+
+// slaveAck is the answer of the slave to a record.
+type slaveAck struct {
+	seq     uint64
+	status  byte
+	elapsed time.Duration
+}
+
+func (a *slaveAck) appendTo(b []byte) []byte {
+	b = binary.BigEndian.AppendUint64(b, a.seq)
+	b = append(b, a.status)
+	return binary.BigEndian.AppendUint32(b, uint32(a.elapsed/time.Microsecond))
+}
+
+func (a *slaveAck) unmarshal(b []byte) error {
+	if len(b) != 13 {
+		return errors.New("bad slave ack")
+	}
+	a.seq = binary.BigEndian.Uint64(b)
+	a.status = b[8]
+	a.elapsed = time.Duration(binary.BigEndian.Uint32(b[9:])) * time.Microsecond
+	return nil
+}
+
+// slaveWindow rejects the replayed sequence numbers of the records received
+// in datagrams: a number is accepted once if it is newer than the highest
+// one received or one of the 64 before it.
+type slaveWindow struct {
+	top  uint64
+	mask uint64
+}
+
+func (w *slaveWindow) accept(seq uint64) bool {
+	switch {
+	case seq > w.top:
+		if shift := seq - w.top; shift < 64 {
+			w.mask = w.mask<<shift | 1
+		} else {
+			w.mask = 1
+		}
+		w.top = seq
+		return true
+	case seq == 0 || w.top-seq >= 64:
+		return false
+	}
+	bit := uint64(1) << (w.top - seq)
+	if w.mask&bit != 0 {
+		return false
+	}
+	w.mask |= bit
+	return true
+}
+
+// slaveFramer reads and writes the frames of a connection of the slave
+// link, authenticated when secret is set. A datagram framer reads and
+// writes a frame per datagram.
+type slaveFramer struct {
+	conn     net.Conn
+	r        *bufio.Reader
+	secret   string
+	nonce    []byte
+	datagram bool
+	wbuf     []byte
+	rbuf     []byte
+}
+
+func newSlaveFramer(conn net.Conn, secret string) *slaveFramer {
+	return &slaveFramer{conn: conn, r: bufio.NewReader(conn), secret: secret}
+}
+
+// mac is the HMAC of a frame, header and payload, bound to the nonce of the
+// connection.
+func (f *slaveFramer) mac(b []byte, frame []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(f.secret))
+	mac.Write(f.nonce)
+	mac.Write(frame)
+	return mac.Sum(b)
+}
+
+// seal appends to b the frame of typ and payload with its mac.
+func (f *slaveFramer) seal(b []byte, typ byte, payload []byte) ([]byte, error) {
+	if len(payload) > 0xffff {
+		return b, errors.New("slave frame too long")
+	}
+	start := len(b)
+	b = append(b, typ)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(payload)))
+	b = append(b, payload...)
+	if f.secret != "" {
+		b = f.mac(b, b[start:])
+	}
+	return b, nil
+}
+
+func (f *slaveFramer) writeFrame(typ byte, payload []byte) error {
+	b, err := f.seal(f.wbuf[:0], typ, payload)
+	if err != nil {
+		return err
+	}
+	f.wbuf = b
+	_, err = f.conn.Write(b)
+	return err
+}
+
+// open checks the length and the mac of the frame b and returns its type
+// and its payload.
+func (f *slaveFramer) open(b []byte) (byte, []byte, error) {
+	if len(b) < 3 {
+		return 0, nil, io.ErrUnexpectedEOF
+	}
+	n := 3 + int(binary.BigEndian.Uint16(b[1:]))
+	if f.secret != "" {
+		n += slaveMACSize
+	}
+	if len(b) != n {
+		return 0, nil, errors.New("bad slave datagram length")
+	}
+	if f.secret != "" {
+		frame, mac := b[:n-slaveMACSize], b[n-slaveMACSize:]
+		var sum [slaveMACSize]byte
+		if !hmac.Equal(mac, f.mac(sum[:0], frame)) {
+			return 0, nil, errSlaveAuth
+		}
+		b = frame
+	}
+	return b[0], b[3:], nil
+}
+
+// readFrame returns the type and the payload of the next frame, the payload
+// is valid until the next call. A datagram framer drops the datagrams which
+// aren't valid frames.
+func (f *slaveFramer) readFrame() (byte, []byte, error) {
+	if f.datagram {
+		if f.rbuf == nil {
+			f.rbuf = make([]byte, slaveMaxDatagram)
+		}
+		for {
+			n, err := f.conn.Read(f.rbuf[:slaveMaxDatagram])
+			if err != nil {
+				return 0, nil, err
+			}
+			if typ, payload, err := f.open(f.rbuf[:n]); err == nil {
+				return typ, payload, nil
+			}
+		}
+	}
+	var hdr [3]byte
+	if _, err := io.ReadFull(f.r, hdr[:]); err != nil {
+		return 0, nil, err
+	}
+	n := 3 + int(binary.BigEndian.Uint16(hdr[1:]))
+	if f.secret != "" {
+		n += slaveMACSize
+	}
+	if cap(f.rbuf) < n {
+		f.rbuf = make([]byte, n)
+	}
+	b := f.rbuf[:n]
+	copy(b, hdr[:])
+	if _, err := io.ReadFull(f.r, b[3:]); err != nil {
+		return 0, nil, err
+	}
+	return f.open(b)
+}
+
+// masterHello sends the hello of the master and reads the one of the slave.
+func (f *slaveFramer) masterHello() error {
+	var hello [len(slaveMagic) + 1 + slaveNonceSize]byte
+	b := append(hello[:0], slaveMagic...)
+	b = append(b, slaveVersion)
+	if f.datagram {
+		// padded to the size of the answer
+		b = hello[:]
+	}
+	if _, err := f.conn.Write(b); err != nil {
+		return err
+	}
+	if err := f.readHello(hello[:]); err != nil {
+		return errors.New("read slave hello failed: " + err.Error())
+	}
+	if string(hello[:len(slaveMagic)]) != slaveMagic {
+		return errors.New("not a slave STUN server")
+	}
+	if v := hello[len(slaveMagic)]; v != slaveVersion {
+		return fmt.Errorf("slave speaks protocol version %d, want %d", v, slaveVersion)
+	}
+	f.nonce = append([]byte(nil), hello[len(slaveMagic)+1:]...)
+	return nil
+}
+
+// readHello reads a hello of the size of b.
+func (f *slaveFramer) readHello(b []byte) error {
+	if !f.datagram {
+		_, err := io.ReadFull(f.r, b)
+		return err
+	}
+	n, err := f.conn.Read(b)
+	if err == nil && n != len(b) {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// slaveHello reads the hello of the master and answers with the one of the
+// slave carrying nonce.
+func (f *slaveFramer) slaveHello(nonce []byte) error {
+	var hello [len(slaveMagic) + 1]byte
+	if _, err := io.ReadFull(f.r, hello[:]); err != nil {
+		return errors.New("read master hello failed: " + err.Error())
+	}
+	if string(hello[:len(slaveMagic)]) != slaveMagic {
+		return errors.New("not a master STUN server")
+	}
+	f.nonce = nonce
+	if _, err := f.conn.Write(append(append([]byte(slaveMagic), slaveVersion), nonce...)); err != nil {
+		return err
+	}
+	if v := hello[len(slaveMagic)]; v != slaveVersion {
+		return fmt.Errorf("master speaks protocol version %d, want %d", v, slaveVersion)
+	}
+	return nil
+}
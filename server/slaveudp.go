@@ -0,0 +1,190 @@
+package server
+
+import (
+	"crypto/rand"
+	"errors"
+	"github.com/bhpike65/go-stun/stun"
+	"net"
+	"strconv"
+	"time"
+)
+
+// slaveMaxSessions bounds the masters a slave serves over UDP, the sessions
+// silent for three heartbeats are dropped for new ones.
+const slaveMaxSessions = 256
+
+// slaveSession is a master sending its records in datagrams, authenticated
+// with the nonce of its hello.
+type slaveSession struct {
+	framer *slaveFramer
+	window slaveWindow
+	seen   time.Time
+}
+
+// slaveHello is the nonce answered to the hello of a master, which starts a
+// session on the first frame the master authenticates with it. The hellos
+// are kept apart from the sessions, at most slaveMaxPending of them, the
+// oldest dropped first: spoofed hellos can't take the place of a session.
+type slaveHello struct {
+	framer *slaveFramer
+	at     time.Time
+}
+
+// startSlaveUDP listens for the datagrams of the master server on
+// slaveServer.
+func (s *Server) startSlaveUDP(slaveServer *net.TCPAddr) error {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: slaveServer.IP, Port: slaveServer.Port, Zone: slaveServer.Zone})
+	if err != nil {
+		return errors.New("slave udp listen error: " + err.Error())
+	}
+	s.track(conn)
+	s.goServe(func() { s.slaveServeUDP(conn) })
+	return nil
+}
+
+// slaveServeUDP answers the hellos and the records of the masters until
+// conn is closed.
+func (s *Server) slaveServeUDP(conn *net.UDPConn) {
+	sessions := make(map[string]*slaveSession)
+	hellos := make(map[string]*slaveHello)
+	buf := make([]byte, slaveMaxDatagram)
+	out := make([]byte, 0, 1500)
+	var r slaveRecord
+	var req stun.StunMessageReq
+	var ack slaveAck
+	var payload [13]byte
+	// the datagrams rejected since the last report, which is logged once
+	// per heartbeat at most
+	var rejected int
+	var reported time.Time
+	reject := func(remote *net.UDPAddr, reason string) {
+		rejected++
+		if time.Since(reported) >= s.config.SlaveHeartbeat {
+			s.logger.Printf("reject %d datagrams of masters, the latest of %s: %s", rejected, remote, reason)
+			rejected, reported = 0, time.Now()
+		}
+	}
+	for {
+		n, remote, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				s.fail(errors.New("slave udp read error: " + err.Error()))
+			}
+			return
+		}
+		b := buf[:n]
+		if len(b) >= len(slaveMagic) && string(b[:len(slaveMagic)]) == slaveMagic {
+			s.slaveHelloUDP(conn, hellos, remote, b)
+			continue
+		}
+		// a frame of a master which sent its hello
+		key := remote.String()
+		sess, hello := sessions[key], hellos[key]
+		if sess == nil && hello == nil {
+			continue
+		}
+		var typ byte
+		var frame []byte
+		if sess != nil {
+			typ, frame, err = sess.framer.open(b)
+		}
+		if sess == nil || err != nil && hello != nil {
+			if typ, frame, err = hello.framer.open(b); err == nil {
+				delete(hellos, key)
+				if sess == nil {
+					if sess = s.slaveSessionUDP(sessions, key); sess == nil {
+						reject(remote, "too many sessions")
+						continue
+					}
+				}
+				// a new session, or the master restarted and so did its
+				// sequence numbers
+				sess.framer, sess.window = hello.framer, slaveWindow{}
+			}
+		}
+		if err != nil {
+			reject(remote, err.Error())
+			continue
+		}
+		sess.seen = time.Now()
+
+		switch typ {
+		case frameHeartbeat:
+			out, _ = sess.framer.seal(out[:0], frameHeartbeat, nil)
+		case frameRecord:
+			if err = r.unmarshal(frame); err != nil {
+				s.logger.Printf("receive error slave data: %s", err.Error())
+				continue
+			}
+			if !sess.window.accept(r.seq) {
+				reject(remote, "replayed record "+strconv.FormatUint(r.seq, 10))
+				continue
+			}
+
+			start := time.Now()
+			ack.seq, ack.status = r.seq, s.slaveRespond(&r, &req, out[:0])
+			ack.elapsed = time.Since(start)
+			out, _ = sess.framer.seal(out[:0], frameAck, ack.appendTo(payload[:0]))
+		default:
+			s.logger.Printf("receive unknown slave frame %d", typ)
+			continue
+		}
+		if _, err = conn.WriteToUDP(out, remote); err != nil {
+			s.logger.Printf("answer to master %s failed: %s", remote, err.Error())
+		}
+	}
+}
+
+// slaveHelloUDP answers the hello of the master at remote with a new nonce,
+// kept in hellos until the master authenticates a frame with it.
+func (s *Server) slaveHelloUDP(conn *net.UDPConn, hellos map[string]*slaveHello, remote *net.UDPAddr, hello []byte) {
+	// the hello of the master is padded to the size of the answer
+	if len(hello) != len(slaveMagic)+1+slaveNonceSize {
+		return
+	}
+	nonce := make([]byte, slaveNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		s.logger.Printf("generate nonce failed: %s", err.Error())
+		return
+	}
+	if _, err := conn.WriteToUDP(append(append([]byte(slaveMagic), slaveVersion), nonce...), remote); err != nil {
+		s.logger.Printf("hello to master %s failed: %s", remote, err.Error())
+		return
+	}
+	if v := hello[len(slaveMagic)]; v != slaveVersion {
+		s.logger.Printf("reject master %s: master speaks protocol version %d, want %d", remote, v, slaveVersion)
+		return
+	}
+	key := remote.String()
+	if hellos[key] == nil && len(hellos) >= slaveMaxPending {
+		var oldest string
+		for k, h := range hellos {
+			if oldest == "" || h.at.Before(hellos[oldest].at) {
+				oldest = k
+			}
+		}
+		delete(hellos, oldest)
+	}
+	f := newSlaveFramer(nil, s.config.SlaveSecret)
+	f.nonce, f.datagram = nonce, true
+	hellos[key] = &slaveHello{framer: f, at: time.Now()}
+}
+
+// slaveSessionUDP adds the session of the master at key, dropping the
+// sessions silent for three heartbeats when there are too many. It returns
+// nil when they are all live.
+func (s *Server) slaveSessionUDP(sessions map[string]*slaveSession, key string) *slaveSession {
+	if len(sessions) >= slaveMaxSessions {
+		for k, sess := range sessions {
+			if time.Since(sess.seen) > 3*s.config.SlaveHeartbeat {
+				delete(sessions, k)
+			}
+		}
+		if len(sessions) >= slaveMaxSessions {
+			return nil
+		}
+	}
+	sess := &slaveSession{}
+	sessions[key] = sess
+	return sess
+}
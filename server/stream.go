@@ -0,0 +1,175 @@
+package server
+
+import (
+	"errors"
+	"github.com/bhpike65/go-stun/stun"
+	"github.com/pion/dtls/v2"
+	"github.com/pion/transport/v2/udp"
+	"io"
+	"net"
+	"time"
+)
+
+// startStunTCPServer serves the STUN over TCP and TLS listeners.
+func (s *Server) startStunTCPServer(l net.Listener) {
+	s.track(l)
+	s.goServe(func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
+				s.logger.Printf("tcp accept error: %s", err)
+				continue
+			}
+			if !s.acquireConn() {
+				conn.Close()
+				continue
+			}
+			s.goServe(func() {
+				defer s.releaseConn()
+				s.serveStunConn(conn, false)
+			})
+		}
+	})
+}
+
+func (s *Server) startStunDTLSServer() error {
+	config := &dtls.Config{
+		Certificates:         s.config.TLSConfig.Certificates,
+		ExtendedMasterSecret: dtls.RequireExtendedMasterSecret,
+	}
+	l, err := (&udp.ListenConfig{}).Listen("udp", &net.UDPAddr{IP: net.ParseIP(s.config.PrimaryAddr), Port: s.config.DTLSPort})
+	if err != nil {
+		return err
+	}
+	s.track(l)
+
+	s.goServe(func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
+				s.logger.Printf("dtls accept error: %s", err)
+				continue
+			}
+			if !s.acquireConn() {
+				conn.Close()
+				continue
+			}
+			// handshake out of the accept loop, a slow client must not block others
+			s.goServe(func() {
+				defer s.releaseConn()
+				if !s.track(conn) {
+					return
+				}
+				dtlsConn, err := dtls.Server(conn, config)
+				s.untrack(conn)
+				if err != nil {
+					s.logger.Printf("dtls handshake with %s failed %s", conn.RemoteAddr(), err.Error())
+					conn.Close()
+					return
+				}
+				s.serveStunConn(dtlsConn, true)
+			})
+		}
+	})
+	return nil
+}
+
+// acquireConn takes the slot of a new connection, it reports false when
+// MaxConns connections are already served.
+func (s *Server) acquireConn() bool {
+	select {
+	case s.connSlots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *Server) releaseConn() {
+	<-s.connSlots
+}
+
+// serveStunConn answers the requests of a TCP, TLS or DTLS connection. Over
+// a stream messages are framed by their length so a malformed header ends
+// the connection, over DTLS each record holds one message.
+func (s *Server) serveStunConn(conn net.Conn, datagram bool) {
+	if !s.track(conn) {
+		return
+	}
+	defer s.untrack(conn)
+	defer conn.Close()
+
+	remote := conn.RemoteAddr()
+	buf := make([]byte, 1500)
+	for {
+		conn.SetReadDeadline(time.Now().Add(s.config.ConnIdleTimeout))
+		var data []byte
+		var err error
+		if datagram {
+			var n int
+			n, err = conn.Read(buf)
+			data = buf[:n]
+		} else {
+			data, err = stun.ReadMessage(conn)
+		}
+		if err != nil {
+			if err != io.EOF && !errors.Is(err, net.ErrClosed) {
+				s.logger.Printf("read from %s failed %s", remote, err.Error())
+			}
+			return
+		}
+
+		var req stun.StunMessageReq
+		if err = req.Unmarshal(data); err != nil {
+			s.logger.Printf("receive error req: %s", err.Error())
+			s.requestError(remote, err)
+			if errResp := req.ErrorResponse(err); errResp != nil {
+				if _, err = conn.Write(errResp.Marshal()); err != nil {
+					s.logger.Printf("respond to %s failed %s", remote, err.Error())
+					return
+				}
+			}
+			continue
+		}
+		if s.config.OnRequest != nil && !s.config.OnRequest(remote, &req) {
+			continue
+		}
+		if errResp, err := s.authenticate(&req); err != nil {
+			s.logger.Printf("reject request from %s: %s", remote, err.Error())
+			s.requestError(remote, err)
+			if _, err = conn.Write(errResp.Marshal()); err != nil {
+				s.logger.Printf("respond to %s failed %s", remote, err.Error())
+				return
+			}
+			continue
+		}
+
+		if req.ChangeIp || req.ChangePort {
+			// a response over a stream can't come from another address
+			err = req.RespondStreamError(conn, 400, "CHANGE-REQUEST is not supported over this transport")
+		} else {
+			err = req.RespondStream(conn, s.otherAddr(addrIP(remote)))
+		}
+		if err != nil {
+			s.logger.Printf("respond to %s failed %s", remote, err.Error())
+			return
+		}
+	}
+}
+
+// addrIP is the IP address of a TCP or UDP address.
+func addrIP(addr net.Addr) net.IP {
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		return addr.IP
+	case *net.UDPAddr:
+		return addr.IP
+	}
+	return nil
+}
@@ -0,0 +1,208 @@
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+	"github.com/bhpike65/go-stun/stun"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"net"
+	"time"
+)
+
+// listenRole opens the sockets of a role, ReusePort of them sharing laddr
+// through SO_REUSEPORT.
+func (s *Server) listenRole(laddr *net.UDPAddr) ([]*net.UDPConn, error) {
+	if s.config.ReusePort <= 1 {
+		conn, err := net.ListenUDP("udp", laddr)
+		if err != nil {
+			return nil, err
+		}
+		s.track(conn)
+		return []*net.UDPConn{conn}, nil
+	}
+
+	conns := make([]*net.UDPConn, 0, s.config.ReusePort)
+	for i := 0; i < s.config.ReusePort; i++ {
+		conn, err := stun.ListenReusePort("udp", laddr)
+		if err != nil {
+			return nil, err
+		}
+		s.track(conn)
+		conns = append(conns, conn)
+	}
+	return conns, nil
+}
+
+// serveRole starts the readers of every socket of a role.
+func (s *Server) serveRole(role int, conns []*net.UDPConn, other *net.UDPAddr) {
+	for _, conn := range conns {
+		conn := conn
+		for i := 0; i < s.config.Readers; i++ {
+			if s.config.Batch > 1 {
+				s.goServe(func() { s.startStunBatchServer(role, conn, other) })
+			} else {
+				s.goServe(func() { s.startStunServer(role, conn, other) })
+			}
+		}
+	}
+}
+
+func (s *Server) startStunServer(role int, conn *net.UDPConn, other *net.UDPAddr) {
+	buf := make([]byte, 1500)
+	out := make([]byte, 0, 1500)
+	// decoding into the same request saves allocations on every packet
+	var req stun.StunMessageReq
+	for {
+		n, remote, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			s.logger.Printf("receive Error: %s", err)
+			continue
+		}
+		reply := s.handleRequest(role, &req, buf[:n], remote, other, out[:0])
+		if reply == nil {
+			continue
+		}
+		out = reply
+		if _, err = conn.WriteToUDP(out, remote); err != nil {
+			s.logger.Printf("respond to %s failed %s", remote, err.Error())
+		}
+	}
+}
+
+// startStunBatchServer is startStunServer reading and writing up to Batch
+// packets per system call, recvmmsg and sendmmsg on Linux.
+func (s *Server) startStunBatchServer(role int, conn *net.UDPConn, other *net.UDPAddr) {
+	var pkConn interface {
+		ReadBatch(ms []ipv4.Message, flags int) (int, error)
+		WriteBatch(ms []ipv4.Message, flags int) (int, error)
+	}
+	if addr := conn.LocalAddr().(*net.UDPAddr); addr.IP.To4() != nil {
+		pkConn = ipv4.NewPacketConn(conn)
+	} else {
+		pkConn = ipv6.NewPacketConn(conn)
+	}
+
+	in := make([]ipv4.Message, s.config.Batch)
+	out := make([]ipv4.Message, s.config.Batch)
+	for i := range in {
+		in[i].Buffers = [][]byte{make([]byte, 1500)}
+		out[i].Buffers = [][]byte{make([]byte, 0, 1500)}
+	}
+	var req stun.StunMessageReq
+	for {
+		n, err := pkConn.ReadBatch(in, 0)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			s.logger.Printf("receive Error: %s", err)
+			continue
+		}
+
+		replies := 0
+		for _, m := range in[:n] {
+			remote, ok := m.Addr.(*net.UDPAddr)
+			if !ok {
+				continue
+			}
+			b := out[replies].Buffers[0][:0]
+			if b = s.handleRequest(role, &req, m.Buffers[0][:m.N], remote, other, b); b == nil {
+				continue
+			}
+			out[replies].Buffers[0] = b
+			out[replies].Addr = remote
+			replies++
+		}
+
+		for sent := 0; sent < replies; {
+			n, err := pkConn.WriteBatch(out[sent:replies], 0)
+			if err != nil {
+				s.logger.Printf("respond to %s failed %s", out[sent].Addr, err.Error())
+				// skip the packet which failed
+				n++
+			}
+			sent += n
+		}
+	}
+}
+
+// handleRequest answers the request in data, received from remote on the
+// socket of role. The response to send back on this socket is appended to
+// out, nil is returned when there's none, e.g. the response of a
+// CHANGE-REQUEST comes from another socket.
+func (s *Server) handleRequest(role int, req *stun.StunMessageReq, data []byte, remote *net.UDPAddr, other *net.UDPAddr, out []byte) []byte {
+	if err := req.Unmarshal(data); err != nil {
+		s.logger.Printf("receive error req: %s", err.Error())
+		s.requestError(remote, err)
+		if errResp := req.ErrorResponse(err); errResp != nil {
+			return errResp.AppendTo(out)
+		}
+		return nil
+	}
+	if s.config.OnRequest != nil && !s.config.OnRequest(remote, req) {
+		return nil
+	}
+	if errResp, err := s.authenticate(req); err != nil {
+		s.logger.Printf("reject request from %s: %s", remote, err.Error())
+		s.requestError(remote, err)
+		return errResp.AppendTo(out)
+	}
+
+	otherRole := role
+	if req.ChangeIp {
+		otherRole ^= 0x02
+	}
+	if req.ChangePort {
+		otherRole ^= 0x01
+	}
+	var node *slaveNode
+	if s.slaves != nil && role == typePP {
+		// the slave of the client answers its CHANGE-REQUEST and is its
+		// OTHER-ADDRESS
+		node = s.slaves.pick(remote.IP)
+		other = node.other
+	}
+	to := responseAddr(req, remote)
+	if otherRole == role && to == remote {
+		return req.AppendResponse(out, remote, other)
+	}
+	if conn := s.roleSet[otherRole]; conn != nil {
+		if otherRole != role {
+			other = nil
+		}
+		if _, err := conn.WriteToUDP(req.AppendResponse(out, remote, other), to); err != nil {
+			s.logger.Printf("respond to %s failed %s", to, err.Error())
+			return req.NewErrorResponse(500, "").AppendTo(out)
+		}
+	} else if s.slaves != nil {
+		if node == nil {
+			node = s.slaves.pick(remote.IP)
+		}
+		// the slave answers from the alternate address, as this server would
+		r := &slaveRecord{role: otherRole, remote: remote, request: append([]byte(nil), data...), queued: time.Now()}
+		if s.config.SlaveTLSConfig != nil {
+			// the key is only sent over an encrypted link
+			r.key = req.IntegrityKey()
+		}
+		s.sendToSlave(node, r)
+	}
+	return nil
+}
+
+// responseAddr is where the response to req goes, the source of the request
+// or the port of its RESPONSE-PORT (RFC 5780 section 7.5) on the source IP.
+func responseAddr(req *stun.StunMessageReq, remote *net.UDPAddr) *net.UDPAddr {
+	v, ok := req.Get(stun.AttrResponsePort)
+	if !ok || len(v) < 2 {
+		return remote
+	}
+	port := int(binary.BigEndian.Uint16(v))
+	if port == 0 || port == remote.Port {
+		return remote
+	}
+	return &net.UDPAddr{IP: remote.IP, Port: port, Zone: remote.Zone}
+}
@@ -0,0 +1,124 @@
+package stun
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"time"
+)
+
+var (
+	ErrUnauthorized = errors.New("stun request is not authenticated")
+	ErrStaleNonce   = errors.New("stun request carries a stale nonce")
+)
+
+// LongTermKey returns the MESSAGE-INTEGRITY key of the long-term credential
+// mechanism: MD5(username ":" realm ":" password).
+func LongTermKey(username, realm, password string) []byte {
+	sum := md5.Sum([]byte(username + ":" + realm + ":" + password))
+	return sum[:]
+}
+
+// CredentialStore looks up the password of a user in a realm.
+type CredentialStore interface {
+	Password(username, realm string) (string, bool)
+}
+
+// StaticCredentials is a CredentialStore with the same users in every realm.
+type StaticCredentials map[string]string
+
+func (c StaticCredentials) Password(username, realm string) (string, bool) {
+	password, ok := c[username]
+	return password, ok
+}
+
+// LongTermAuth is the server side of the long-term credential mechanism,
+// RFC 5389 section 10.2. Nonces are stateless: a timestamp signed with a
+// random per-process secret, they become stale after NonceExpiry.
+type LongTermAuth struct {
+	Realm       string
+	Credentials CredentialStore
+	NonceExpiry time.Duration
+
+	secret []byte
+}
+
+// NewLongTermAuth returns the long-term credential mechanism of realm, it
+// fails when the nonce secret can't be generated.
+func NewLongTermAuth(realm string, creds CredentialStore) (*LongTermAuth, error) {
+	secret := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, secret); err != nil {
+		return nil, errors.New("generate nonce secret failed: " + err.Error())
+	}
+	return &LongTermAuth{
+		Realm:       realm,
+		Credentials: creds,
+		NonceExpiry: 10 * time.Minute,
+		secret:      secret,
+	}, nil
+}
+
+// Authenticate checks the USERNAME, REALM, NONCE and MESSAGE-INTEGRITY of req.
+// On success the response sent by req.RespondTo is signed with the user key,
+// otherwise the returned error response holds the challenge to send back.
+func (a *LongTermAuth) Authenticate(req *StunMessageReq) (*StunMessageResp, error) {
+	if _, ok := req.Get(AttrIntegrity); !ok {
+		return a.challenge(req, errUnauthorized), ErrUnauthorized
+	}
+
+	username, errUser := req.GetString(AttrUsername)
+	realm, errRealm := req.GetString(AttrRealm)
+	nonce, errNonce := req.GetString(AttrNonce)
+	if errUser != nil || errRealm != nil || errNonce != nil {
+		return req.NewErrorResponse(errBadRequest, ""), ErrUnauthorized
+	}
+
+	if !a.validNonce(nonce) {
+		return a.challenge(req, errStaleNonce), ErrStaleNonce
+	}
+
+	password, ok := a.Credentials.Password(username, realm)
+	if !ok || realm != a.Realm {
+		return a.challenge(req, errUnauthorized), ErrUnauthorized
+	}
+	key := LongTermKey(username, realm, password)
+	if err := req.CheckIntegrity(key); err != nil {
+		return a.challenge(req, errUnauthorized), err
+	}
+	req.key = key
+	return nil, nil
+}
+
+func (a *LongTermAuth) challenge(req *StunMessageReq, code int) *StunMessageResp {
+	resp := req.NewErrorResponse(code, "")
+	resp.SetString(AttrRealm, a.Realm)
+	resp.SetString(AttrNonce, a.newNonce(time.Now()))
+	return resp
+}
+
+func (a *LongTermAuth) newNonce(now time.Time) string {
+	ts := make([]byte, 8)
+	binary.BigEndian.PutUint64(ts, uint64(now.Unix()))
+	mac := hmac.New(sha1.New, a.secret)
+	mac.Write(ts)
+	return hex.EncodeToString(ts) + hex.EncodeToString(mac.Sum(nil)[:8])
+}
+
+func (a *LongTermAuth) validNonce(nonce string) bool {
+	raw, err := hex.DecodeString(nonce)
+	if err != nil || len(raw) != 16 {
+		return false
+	}
+	mac := hmac.New(sha1.New, a.secret)
+	mac.Write(raw[:8])
+	if !hmac.Equal(mac.Sum(nil)[:8], raw[8:]) {
+		return false
+	}
+	issued := time.Unix(int64(binary.BigEndian.Uint64(raw)), 0)
+	return time.Since(issued) < a.NonceExpiry
+}
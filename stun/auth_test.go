@@ -0,0 +1,200 @@
+package stun
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// receive returns req as decoded by the server.
+func receive(t *testing.T, req *StunMessageReq) *StunMessageReq {
+	t.Helper()
+	var got StunMessageReq
+	if err := got.Unmarshal(req.Marshal()); err != nil {
+		t.Fatal(err)
+	}
+	return &got
+}
+
+// challenged checks that resp is a code error with REALM and NONCE and
+// returns it as decoded by the client.
+func challenged(t *testing.T, resp *StunMessageResp, code int) *StunMessageResp {
+	t.Helper()
+	if resp == nil {
+		t.Fatalf("no %d response", code)
+	}
+	var got StunMessageResp
+	if err := got.Unmarshal(resp.Marshal()); err != nil {
+		t.Fatal(err)
+	}
+	if int(got.ErrorCode) != code {
+		t.Fatalf("error %d, want %d", got.ErrorCode, code)
+	}
+	if realm, err := got.GetString(AttrRealm); err != nil || realm != "example.org" {
+		t.Errorf("realm %q %v", realm, err)
+	}
+	if nonce, err := got.GetString(AttrNonce); err != nil || nonce == "" {
+		t.Errorf("nonce %q %v", nonce, err)
+	}
+	return &got
+}
+
+func TestLongTermAuth(t *testing.T) {
+	a, err := NewLongTermAuth("example.org", StaticCredentials{"alice": "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a request without credentials is challenged, then retried with them
+	client := NewBindRequest(nil)
+	client.SetLongTermCredentials("alice", "secret")
+	resp, err := a.Authenticate(receive(t, client))
+	if err != ErrUnauthorized {
+		t.Errorf("error %v, want %v", err, ErrUnauthorized)
+	}
+	if !client.handleChallenge(challenged(t, resp, 401)) {
+		t.Fatal("401 challenge not answered")
+	}
+	client.newTransaction()
+	req := receive(t, client)
+	if resp, err = a.Authenticate(req); resp != nil || err != nil {
+		t.Fatalf("authenticated request rejected: %+v %v", resp, err)
+	}
+	if string(req.IntegrityKey()) != string(LongTermKey("alice", "example.org", "secret")) {
+		t.Error("response not signed with the user key")
+	}
+
+	// a stale nonce is answered with 438 and a new nonce
+	client.nonce = a.newNonce(time.Now().Add(-time.Hour))
+	resp, err = a.Authenticate(receive(t, client))
+	if err != ErrStaleNonce {
+		t.Errorf("error %v, want %v", err, ErrStaleNonce)
+	}
+	if !client.handleChallenge(challenged(t, resp, 438)) {
+		t.Fatal("438 challenge not answered")
+	}
+	if resp, err = a.Authenticate(receive(t, client)); resp != nil || err != nil {
+		t.Fatalf("request with the new nonce rejected: %+v %v", resp, err)
+	}
+
+	// a forged nonce is stale as well
+	client.nonce = "0000000000000000deadbeefdeadbeef"
+	if _, err = a.Authenticate(receive(t, client)); err != ErrStaleNonce {
+		t.Errorf("forged nonce: error %v, want %v", err, ErrStaleNonce)
+	}
+
+	// a wrong password or an unknown user is challenged again, and the
+	// client gives up
+	for _, user := range [][2]string{{"alice", "wrong"}, {"bob", "secret"}} {
+		client = NewBindRequest(nil)
+		client.SetLongTermCredentials(user[0], user[1])
+		resp, _ = a.Authenticate(receive(t, client))
+		client.handleChallenge(challenged(t, resp, 401))
+		resp, err = a.Authenticate(receive(t, client))
+		if err == nil {
+			t.Fatalf("%s: request accepted", user)
+		}
+		if client.handleChallenge(challenged(t, resp, 401)) {
+			t.Errorf("%s: rejected credentials sent again", user)
+		}
+	}
+}
+
+func TestHandleChallenge(t *testing.T) {
+	challenge := func(code int, realm, nonce string) *StunMessageResp {
+		resp := NewBindRequest(nil).NewErrorResponse(code, "")
+		if realm != "" {
+			resp.SetString(AttrRealm, realm)
+		}
+		if nonce != "" {
+			resp.SetString(AttrNonce, nonce)
+		}
+		var got StunMessageResp
+		if err := got.Unmarshal(resp.Marshal()); err != nil {
+			t.Fatal(err)
+		}
+		return &got
+	}
+
+	req := NewBindRequest(nil)
+	if req.handleChallenge(challenge(401, "example.org", "n1")) {
+		t.Error("challenge answered without credentials")
+	}
+	req.SetLongTermCredentials("alice", "secret")
+	for _, c := range []struct {
+		resp *StunMessageResp
+		ok   bool
+	}{
+		{challenge(401, "", "n1"), false},
+		{challenge(401, "example.org", ""), false},
+		{challenge(400, "example.org", "n1"), false},
+		{challenge(401, "example.org", "n1"), true},
+		// the same credentials were rejected
+		{challenge(401, "example.org", "n2"), false},
+		{challenge(438, "example.org", "n3"), true},
+	} {
+		if ok := req.handleChallenge(c.resp); ok != c.ok {
+			t.Errorf("%d %v: answered %v, want %v", c.resp.ErrorCode, c.resp.Attributes, ok, c.ok)
+		}
+	}
+	if req.realm != "example.org" || req.nonce != "n3" || string(req.key) != string(LongTermKey("alice", "example.org", "secret")) {
+		t.Errorf("credentials %q %q %x", req.realm, req.nonce, req.key)
+	}
+}
+
+func TestRequestLongTerm(t *testing.T) {
+	a, err := NewLongTermAuth("example.org", StaticCredentials{"alice": "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	var mu sync.Mutex
+	requests := 0
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, remote, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			var req StunMessageReq
+			if req.Unmarshal(buf[:n]) != nil {
+				continue
+			}
+			mu.Lock()
+			requests++
+			mu.Unlock()
+			if resp, _ := a.Authenticate(&req); resp != nil {
+				conn.WriteToUDP(resp.Marshal(), remote)
+			} else {
+				req.RespondTo(conn, remote, nil)
+			}
+		}
+	}()
+
+	for _, c := range []struct {
+		password string
+		ok       bool
+	}{{"secret", true}, {"wrong", false}} {
+		mu.Lock()
+		requests = 0
+		mu.Unlock()
+		req := NewBindRequest(nil)
+		req.SetLongTermCredentials("alice", c.password)
+		req.Options = &ClientOptions{RTO: 100 * time.Millisecond, Rc: 3, Rm: 4}
+		resp, _, err := req.Request("127.0.0.1:0", conn.LocalAddr().String())
+		if (err == nil) != c.ok {
+			t.Errorf("%s: %+v %v", c.password, resp, err)
+		}
+		mu.Lock()
+		if requests != 2 {
+			t.Errorf("%s: %d requests, want the challenged one and its retry", c.password, requests)
+		}
+		mu.Unlock()
+	}
+}
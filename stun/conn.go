@@ -0,0 +1,74 @@
+package stun
+
+import (
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"net"
+	"time"
+)
+
+// packetConn is a UDP socket which reports the local address every packet
+// was received on, through IP_PKTINFO or IPV6_RECVPKTINFO.
+type packetConn interface {
+	writeTo(b []byte, to net.Addr) (int, error)
+	readFrom(b []byte) (n int, dst net.IP, src net.Addr, err error)
+	SetReadDeadline(t time.Time) error
+}
+
+type ipv4Conn struct {
+	*ipv4.PacketConn
+}
+
+func (c ipv4Conn) writeTo(b []byte, to net.Addr) (int, error) {
+	return c.WriteTo(b, nil, to)
+}
+
+func (c ipv4Conn) readFrom(b []byte) (int, net.IP, net.Addr, error) {
+	n, cm, src, err := c.ReadFrom(b)
+	if cm == nil {
+		return n, nil, src, err
+	}
+	return n, cm.Dst, src, err
+}
+
+type ipv6Conn struct {
+	*ipv6.PacketConn
+}
+
+func (c ipv6Conn) writeTo(b []byte, to net.Addr) (int, error) {
+	return c.WriteTo(b, nil, to)
+}
+
+func (c ipv6Conn) readFrom(b []byte) (int, net.IP, net.Addr, error) {
+	n, cm, src, err := c.ReadFrom(b)
+	if cm == nil {
+		return n, nil, src, err
+	}
+	return n, cm.Dst, src, err
+}
+
+// newPacketConn picks the control messages matching the family of the
+// socket, a socket bound to an unspecified IPv6 address may be dual-stack.
+func newPacketConn(conn *net.UDPConn) packetConn {
+	if addr, ok := conn.LocalAddr().(*net.UDPAddr); ok && addr.IP.To4() != nil {
+		pkConn := ipv4.NewPacketConn(conn)
+		pkConn.SetControlMessage(ipv4.FlagDst, true)
+		return ipv4Conn{pkConn}
+	}
+	pkConn := ipv6.NewPacketConn(conn)
+	pkConn.SetControlMessage(ipv6.FlagDst, true)
+	return ipv6Conn{pkConn}
+}
+
+// UDPNetwork returns the network to resolve remote addresses with, so that
+// they have the same family as the local address.
+func UDPNetwork(local *net.UDPAddr) string {
+	switch {
+	case local == nil || local.IP == nil || local.IP.IsUnspecified():
+		return "udp"
+	case local.IP.To4() != nil:
+		return "udp4"
+	default:
+		return "udp6"
+	}
+}
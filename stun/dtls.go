@@ -0,0 +1,57 @@
+package stun
+
+import (
+	"context"
+	"github.com/pion/dtls/v2"
+	"net"
+)
+
+// dtlsConn carries STUN over a DTLS association, every record holds one
+// message and requests are retransmitted as over plain UDP.
+type dtlsConn struct {
+	*dtls.Conn
+}
+
+func (c dtlsConn) writeTo(b []byte, to net.Addr) (int, error) {
+	return c.Write(b)
+}
+
+func (c dtlsConn) readFrom(b []byte) (int, net.IP, net.Addr, error) {
+	n, err := c.Read(b)
+	return n, nil, c.RemoteAddr(), err
+}
+
+// RequestDTLS sends req to remoteAddr over DTLS, the stuns: transport on
+// UDP. The certificate of the server is verified against config.ServerName.
+func (req *StunMessageReq) RequestDTLS(localAddr, remoteAddr string, config *dtls.Config) (*StunMessageResp, *net.UDPAddr, error) {
+	return req.RequestDTLSContext(context.Background(), localAddr, remoteAddr, config)
+}
+
+func (req *StunMessageReq) RequestDTLSContext(ctx context.Context, localAddr, remoteAddr string, config *dtls.Config) (*StunMessageResp, *net.UDPAddr, error) {
+	var local *net.UDPAddr
+	if localAddr != "" {
+		var err error
+		if local, err = net.ResolveUDPAddr("udp", localAddr); err != nil {
+			return nil, nil, err
+		}
+	}
+	remote, err := net.ResolveUDPAddr(UDPNetwork(local), remoteAddr)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sock, err := net.DialUDP("udp", local, remote)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer sock.Close()
+
+	conn, err := dtls.ClientWithContext(ctx, sock, config)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer conn.Close()
+
+	loc := sock.LocalAddr().(*net.UDPAddr)
+	return req.requestPacketConn(ctx, dtlsConn{conn}, remote, loc)
+}
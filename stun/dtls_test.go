@@ -0,0 +1,97 @@
+package stun
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"github.com/pion/dtls/v2"
+	"github.com/pion/dtls/v2/pkg/crypto/selfsign"
+	"net"
+	"testing"
+	"time"
+)
+
+// startDTLSServer answers the Binding requests of one DTLS client on the
+// loopback interface, it returns the server address and its certificate.
+func startDTLSServer(t *testing.T) (string, tls.Certificate) {
+	cert, err := selfsign.GenerateSelfSignedWithDNS("stun.example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &dtls.Config{
+		Certificates:         []tls.Certificate{cert},
+		ExtendedMasterSecret: dtls.RequireExtendedMasterSecret,
+	}
+	l, err := dtls.Listen("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		buf := make([]byte, 1500)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return
+			}
+			var req StunMessageReq
+			if err = req.Unmarshal(buf[:n]); err != nil {
+				t.Error("server unmarshal: ", err)
+				return
+			}
+			if err = req.RespondStream(conn, nil); err != nil {
+				t.Error("server respond: ", err)
+				return
+			}
+		}
+	}()
+
+	return l.Addr().String(), cert
+}
+
+func clientConfig(t *testing.T, cert tls.Certificate, serverName string) *dtls.Config {
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(leaf)
+	return &dtls.Config{
+		RootCAs:              roots,
+		ServerName:           serverName,
+		ExtendedMasterSecret: dtls.RequireExtendedMasterSecret,
+	}
+}
+
+func TestRequestDTLS(t *testing.T) {
+	server, cert := startDTLSServer(t)
+
+	req := NewBindRequest(nil)
+	req.Options = &ClientOptions{RTO: 100 * time.Millisecond, Rc: 3, Rm: 4}
+	resp, local, err := req.RequestDTLS("127.0.0.1:0", server, clientConfig(t, cert, "stun.example.org"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Addr.String() != local.String() {
+		t.Errorf("mapped address %s, want %s", resp.Addr, local)
+	}
+	if resp.TransacrtonId != req.TransacrtonId {
+		t.Error("transaction ID mismatch")
+	}
+}
+
+func TestRequestDTLSServerName(t *testing.T) {
+	server, cert := startDTLSServer(t)
+
+	req := NewBindRequest(nil)
+	_, _, err := req.RequestDTLS("127.0.0.1:0", server, clientConfig(t, cert, "other.example.org"))
+	if err == nil {
+		t.Fatal("handshake succeeded with a wrong server name")
+	}
+}
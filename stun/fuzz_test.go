@@ -0,0 +1,163 @@
+package stun
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+// fuzzSeeds are well-formed and truncated messages for the corpus of the
+// decoders, run them with e.g. go test -fuzz FuzzRequestUnmarshal ./stun.
+func fuzzSeeds() [][]byte {
+	seeds := [][]byte{
+		rfc5769Request,
+		rfc5769ResponseIPv4,
+		rfc5769ResponseIPv6,
+		rfc5769LongTermRequest,
+		{},
+		rfc5769Request[:headerLen-1],
+		rfc5769Request[:headerLen],
+	}
+
+	req := NewBindRequest(make([]byte, 12))
+	req.SetChangeIP(true)
+	req.SetChangePort(true)
+	seeds = append(seeds, req.Marshal())
+
+	// CHANGE-REQUEST, ERROR-CODE and addresses with short values
+	for _, t := range []uint16{AttrChangeRequest, AttrErrCode, AttrAddress, AttrXorAddress, AttrUnknownAttrs} {
+		msg := NewMessage(ClassRequest, MethodBinding, make([]byte, 12))
+		msg.Add(t, []byte{0x00, 0x01})
+		seeds = append(seeds, msg.Marshal())
+	}
+
+	msg := NewMessage(ClassIndication, MethodBinding, make([]byte, 12))
+	msg.AddFingerprint()
+	seeds = append(seeds, msg.Marshal())
+
+	resp := req.NewErrorResponse(errUnknownAttribute, "")
+	resp.SetUnknownAttributes([]uint16{0x0003, 0x7fff})
+	resp.Fingerprint = true
+	seeds = append(seeds, resp.Marshal())
+
+	resp = req.NewResponse(&net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 3478}, &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 3479})
+	seeds = append(seeds, resp.Marshal())
+	return seeds
+}
+
+func FuzzMessageUnmarshal(f *testing.F) {
+	for _, seed := range fuzzSeeds() {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var msg Message
+		err := msg.Unmarshal(data)
+		if IsMessage(data) != (err == nil) {
+			t.Fatalf("IsMessage %v, Unmarshal error %v", IsMessage(data), err)
+		}
+		if err != nil {
+			return
+		}
+
+		// the accessors must not panic on whatever the attributes hold
+		msg.GetAddress(AttrAddress)
+		msg.GetXorAddress(AttrXorAddress)
+		msg.GetChangeRequest()
+		msg.GetErrorCode()
+		msg.GetUnknownAttributes()
+		msg.GetString(AttrSoftware)
+		msg.CheckIntegrity([]byte("key"))
+
+		// the padding may change, so does the fingerprint, the attributes don't
+		msg.Remove(AttrFingerprint)
+		var again Message
+		if err := again.Unmarshal(msg.Marshal()); err != nil {
+			t.Fatal("re-encoded message: ", err)
+		}
+		if len(again.Attributes) != len(msg.Attributes) {
+			t.Fatal("attributes changed by re-encoding")
+		}
+		for i, a := range again.Attributes {
+			if a.Type != msg.Attributes[i].Type || !bytes.Equal(a.Value, msg.Attributes[i].Value) {
+				t.Fatal("attributes changed by re-encoding")
+			}
+		}
+	})
+}
+
+func FuzzRequestUnmarshal(f *testing.F) {
+	for _, seed := range fuzzSeeds() {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var req StunMessageReq
+		if err := req.Unmarshal(data); err != nil {
+			// what the server answers to a request it can't decode
+			req.ErrorResponse(err)
+			return
+		}
+		req.CheckShortTermCredentials("password")
+		resp := req.NewResponse(&net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 3478}, nil)
+		resp.Marshal()
+	})
+}
+
+func FuzzResponseUnmarshal(f *testing.F) {
+	for _, seed := range fuzzSeeds() {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var resp StunMessageResp
+		if err := resp.Unmarshal(data); err != nil {
+			return
+		}
+		if resp.Addr != nil && resp.Addr.IP.To16() == nil {
+			t.Fatalf("bad mapped address %v", resp.Addr)
+		}
+		resp.GetUnknownAttributes()
+		resp.CheckIntegrity([]byte("key"))
+	})
+}
+
+func FuzzReadMessage(f *testing.F) {
+	for _, seed := range fuzzSeeds() {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		msg, err := ReadMessage(bytes.NewReader(data))
+		if err != nil {
+			return
+		}
+		if !bytes.HasPrefix(data, msg) {
+			t.Fatal("message is not a prefix of the stream")
+		}
+	})
+}
+
+func FuzzParseURI(f *testing.F) {
+	for _, seed := range []string{
+		"stun:stun.example.org",
+		"stuns:stun.example.org:5349?transport=tcp",
+		"stun:[2001:db8::1]:3478?transport=udp",
+		"stun:192.0.2.1:",
+		"stun://stun.example.org",
+		"stun:[::1",
+		"example.org:3478",
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, s string) {
+		u, err := ParseServer(s)
+		if err != nil {
+			return
+		}
+		again, err := ParseURI(u.String())
+		if err != nil {
+			t.Fatalf("%q: %s does not parse: %s", s, u, err)
+		}
+		if *again != *u {
+			t.Fatalf("%q: %+v parsed again as %+v", s, u, again)
+		}
+		u.Addr()
+	})
+}
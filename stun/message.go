@@ -0,0 +1,531 @@
+package stun
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"net"
+)
+
+/*
+    0                   1                   2                   3
+    0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1
+   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+   |         Type                  |            Length             |
+   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+   |                         Value (variable)                ....
+   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+
+                    Figure 4: Format of STUN Attributes
+*/
+
+var (
+	ErrAttributeNotFound = errors.New("stun attribute not found")
+	ErrMalformedMessage  = errors.New("stun message format error")
+	ErrMalformedAttr     = errors.New("stun attribute format error")
+	ErrIntegrityMismatch = errors.New("stun message integrity check failed")
+	ErrFingerprint       = errors.New("stun message fingerprint check failed")
+)
+
+const (
+	fingerprintXor  = 0x5354554e
+	fingerprintSize = 8
+)
+
+// Attribute is a raw STUN attribute, Value holds the unpadded attribute value.
+type Attribute struct {
+	Type  uint16
+	Value []byte
+}
+
+// Message is a generic STUN message of any class and method. Attributes
+// are kept in wire order, including the ones this package does not know.
+type Message struct {
+	header
+	Attributes []Attribute
+
+	raw []byte
+}
+
+// NewMessage returns an empty message of the given class and method, a random
+// transaction ID is generated if tid is nil.
+func NewMessage(class uint8, method uint16, tid []byte) *Message {
+	var m Message
+
+	if tid == nil {
+		tid = make([]byte, 12)
+		if _, err := io.ReadFull(rand.Reader, tid); err != nil {
+			return nil
+		}
+	}
+	copy(m.TransacrtonId[:], tid)
+	m.Type = getMsgType(class, method)
+	m.Magic = magic
+
+	return &m
+}
+
+func (m *Message) Class() uint8 {
+	return classFromMsgType(m.Type)
+}
+
+func (m *Message) Method() uint16 {
+	return methodFromMsgType(m.Type)
+}
+
+// Add appends an attribute to the message, the value is copied.
+func (m *Message) Add(t uint16, v []byte) {
+	value := make([]byte, len(v))
+	copy(value, v)
+	m.Attributes = append(m.Attributes, Attribute{Type: t, Value: value})
+}
+
+// Get returns the value of the first attribute of type t.
+func (m *Message) Get(t uint16) ([]byte, bool) {
+	for _, a := range m.Attributes {
+		if a.Type == t {
+			return a.Value, true
+		}
+	}
+	return nil, false
+}
+
+// GetAll returns the values of all the attributes of type t, in wire order.
+func (m *Message) GetAll(t uint16) [][]byte {
+	var values [][]byte
+	for _, a := range m.Attributes {
+		if a.Type == t {
+			values = append(values, a.Value)
+		}
+	}
+	return values
+}
+
+// Remove deletes all the attributes of type t.
+func (m *Message) Remove(t uint16) {
+	attrs := m.Attributes[:0]
+	for _, a := range m.Attributes {
+		if a.Type != t {
+			attrs = append(attrs, a)
+		}
+	}
+	m.Attributes = attrs
+}
+
+func (m *Message) set(t uint16, v []byte) {
+	m.Remove(t)
+	m.Attributes = append(m.Attributes, Attribute{Type: t, Value: v})
+}
+
+func (m *Message) Marshal() []byte {
+	size := headerLen
+	for _, a := range m.Attributes {
+		size += 4 + padLen(len(a.Value))
+	}
+	return m.AppendTo(make([]byte, 0, size))
+}
+
+// AppendTo appends the message in wire format to b and returns the extended
+// buffer, it doesn't allocate when b has enough capacity.
+func (m *Message) AppendTo(b []byte) []byte {
+	start := len(b)
+	b = appendHeader(b, &m.header)
+	for _, a := range m.Attributes {
+		b = appendAttr(b, a.Type, a.Value)
+	}
+	m.Length = setLength(b[start:])
+	return b
+}
+
+// Unmarshal decodes data into m. The buffers of m are reused, so the attribute
+// values of a previous Unmarshal are overwritten.
+func (m *Message) Unmarshal(data []byte) error {
+	// nothing of a previous message must be left when data isn't one, the
+	// error response would be built from it
+	m.header = header{}
+	m.Attributes = m.Attributes[:0]
+	m.raw = m.raw[:0]
+	if len(data) < headerLen || data[0]&0xc0 != 0 {
+		return ErrMalformedMessage
+	}
+	raw := append(m.raw, data...)
+
+	m.Type = binary.BigEndian.Uint16(raw[0:])
+	m.Length = binary.BigEndian.Uint16(raw[2:])
+	m.Magic = binary.BigEndian.Uint32(raw[4:])
+	copy(m.TransacrtonId[:], raw[8:headerLen])
+	if m.Magic != magic || int(m.Length)+headerLen != len(raw) || m.Length%4 != 0 {
+		return ErrMalformedMessage
+	}
+
+	m.raw = raw
+	attrs := raw[headerLen:]
+	for len(attrs) > 0 {
+		if len(attrs) < 4 {
+			return ErrMalformedAttr
+		}
+		t := binary.BigEndian.Uint16(attrs[0:])
+		l := int(binary.BigEndian.Uint16(attrs[2:]))
+		if len(attrs) < 4+padLen(l) {
+			return ErrMalformedAttr
+		}
+		m.Attributes = append(m.Attributes, Attribute{Type: t, Value: attrs[4 : 4+l : 4+l]})
+		attrs = attrs[4+padLen(l):]
+
+		if t == AttrFingerprint && (l != 4 || len(attrs) != 0 || !checkFingerprint(raw)) {
+			return ErrFingerprint
+		}
+	}
+
+	return nil
+}
+
+// SetAddress sets a MAPPED-ADDRESS style attribute, e.g. OTHER-ADDRESS.
+func (m *Message) SetAddress(t uint16, addr *net.UDPAddr) {
+	m.set(t, appendAddress(nil, t, addr, nil)[4:])
+}
+
+func (m *Message) GetAddress(t uint16) (*net.UDPAddr, error) {
+	v, ok := m.Get(t)
+	if !ok {
+		return nil, ErrAttributeNotFound
+	}
+	ip, port, err := parseAddress(v)
+	if err != nil {
+		return nil, err
+	}
+	return &net.UDPAddr{IP: ip, Port: port}, nil
+}
+
+// SetXorAddress sets a XOR-MAPPED-ADDRESS style attribute, the address is
+// obfuscated with the magic cookie and the transaction ID of the message.
+func (m *Message) SetXorAddress(t uint16, addr *net.UDPAddr) {
+	key := m.xorKey()
+	m.set(t, appendAddress(nil, t, addr, &key)[4:])
+}
+
+func (m *Message) GetXorAddress(t uint16) (*net.UDPAddr, error) {
+	v, ok := m.Get(t)
+	if !ok {
+		return nil, ErrAttributeNotFound
+	}
+	ip, port, err := parseAddress(v)
+	if err != nil {
+		return nil, err
+	}
+	key := m.xorKey()
+	for i := range ip {
+		ip[i] ^= key[i]
+	}
+	port ^= magic >> 16
+	return &net.UDPAddr{IP: ip, Port: port}, nil
+}
+
+func (m *Message) SetChangeRequest(changeIp, changePort bool) {
+	m.set(AttrChangeRequest, appendChangeRequest(nil, changeIp, changePort)[4:])
+}
+
+func (m *Message) GetChangeRequest() (changeIp bool, changePort bool, err error) {
+	v, ok := m.Get(AttrChangeRequest)
+	if !ok {
+		return false, false, ErrAttributeNotFound
+	}
+	if len(v) != 4 {
+		return false, false, ErrMalformedAttr
+	}
+	flags := binary.BigEndian.Uint32(v)
+	return flags&0x04 != 0, flags&0x02 != 0, nil
+}
+
+/*
+    0                   1                   2                   3
+    0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1
+   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+   |           Reserved, should be 0         |Class|     Number    |
+   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+   |      Reason Phrase (variable)                                ..
+   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+*/
+
+func (m *Message) SetErrorCode(code int, reason string) {
+	v := appendErrorCode(nil, code, reason)[4:]
+	m.set(AttrErrCode, v[:4+len(reason)])
+}
+
+func (m *Message) GetErrorCode() (int, string, error) {
+	v, ok := m.Get(AttrErrCode)
+	if !ok {
+		return 0, "", ErrAttributeNotFound
+	}
+	if len(v) < 4 {
+		return 0, "", ErrMalformedAttr
+	}
+	return int(v[2]&0x07)*100 + int(v[3]), string(v[4:]), nil
+}
+
+// SetUnknownAttributes sets the UNKNOWN-ATTRIBUTES attribute of a 420 error.
+func (m *Message) SetUnknownAttributes(types []uint16) {
+	v := make([]byte, 2*len(types))
+	for i, t := range types {
+		binary.BigEndian.PutUint16(v[2*i:], t)
+	}
+	m.set(AttrUnknownAttrs, v)
+}
+
+func (m *Message) GetUnknownAttributes() ([]uint16, error) {
+	v, ok := m.Get(AttrUnknownAttrs)
+	if !ok {
+		return nil, ErrAttributeNotFound
+	}
+	if len(v)%2 != 0 {
+		return nil, ErrMalformedAttr
+	}
+	types := make([]uint16, len(v)/2)
+	for i := range types {
+		types[i] = binary.BigEndian.Uint16(v[2*i:])
+	}
+	return types, nil
+}
+
+// SetString sets a text attribute such as SOFTWARE, USERNAME, REALM or NONCE.
+func (m *Message) SetString(t uint16, s string) {
+	m.set(t, []byte(s))
+}
+
+func (m *Message) GetString(t uint16) (string, error) {
+	v, ok := m.Get(t)
+	if !ok {
+		return "", ErrAttributeNotFound
+	}
+	return string(v), nil
+}
+
+// AddIntegrity appends a MESSAGE-INTEGRITY attribute, an HMAC-SHA1 keyed
+// with key over the message as marshaled so far. It must be the last
+// attribute added, except for FINGERPRINT.
+func (m *Message) AddIntegrity(key []byte) {
+	m.Remove(AttrIntegrity)
+	m.Remove(AttrFingerprint)
+
+	data := appendIntegrity(m.Marshal(), 0, key)
+	m.Attributes = append(m.Attributes, Attribute{Type: AttrIntegrity, Value: data[len(data)-sha1.Size:]})
+}
+
+// CheckIntegrity verifies the MESSAGE-INTEGRITY attribute of the message with
+// key. For a received message it is computed over the bytes as received.
+func (m *Message) CheckIntegrity(key []byte) error {
+	data := m.raw
+	if len(data) == 0 {
+		data = m.Marshal()
+	}
+
+	off := headerLen
+	for off+4 <= len(data) {
+		t := binary.BigEndian.Uint16(data[off:])
+		l := int(binary.BigEndian.Uint16(data[off+2:]))
+		if t == AttrIntegrity {
+			if l != sha1.Size || off+4+l > len(data) {
+				return ErrMalformedAttr
+			}
+			// the length must end right after the MESSAGE-INTEGRITY attribute,
+			// ignoring whatever follows it (i.e. FINGERPRINT)
+			buf := make([]byte, off)
+			copy(buf, data[:off])
+			binary.BigEndian.PutUint16(buf[2:], uint16(off-headerLen+4+sha1.Size))
+
+			mac := hmac.New(sha1.New, key)
+			mac.Write(buf)
+			if !hmac.Equal(mac.Sum(nil), data[off+4:off+4+l]) {
+				return ErrIntegrityMismatch
+			}
+			return nil
+		}
+		off += 4 + padLen(l)
+	}
+	return ErrAttributeNotFound
+}
+
+// AddFingerprint appends a FINGERPRINT attribute, the CRC-32 of the message
+// XOR-ed with 0x5354554e. It must be the last attribute of the message.
+func (m *Message) AddFingerprint() {
+	m.Remove(AttrFingerprint)
+
+	data := appendFingerprint(m.Marshal(), 0)
+	m.Attributes = append(m.Attributes, Attribute{Type: AttrFingerprint, Value: data[len(data)-4:]})
+}
+
+// IsMessage reports whether data looks like a STUN message, it is cheap enough
+// to demultiplex STUN from other protocols sharing the same port. When the
+// message ends with a FINGERPRINT attribute, the fingerprint is verified too.
+func IsMessage(data []byte) bool {
+	if len(data) < headerLen || data[0]&0xc0 != 0 ||
+		binary.BigEndian.Uint32(data[4:]) != magic {
+		return false
+	}
+	l := int(binary.BigEndian.Uint16(data[2:]))
+	if l%4 != 0 || l+headerLen != len(data) {
+		return false
+	}
+	// walk the attribute headers, the last 8 bytes may as well be the end of
+	// another attribute value looking like a FINGERPRINT
+	for off := headerLen; off < len(data); {
+		if off+4 > len(data) {
+			return false
+		}
+		t := binary.BigEndian.Uint16(data[off:])
+		l := int(binary.BigEndian.Uint16(data[off+2:]))
+		if off += 4 + padLen(l); off > len(data) {
+			return false
+		}
+		if t == AttrFingerprint {
+			return l == 4 && off == len(data) && checkFingerprint(data)
+		}
+	}
+	return true
+}
+
+// checkFingerprint verifies the FINGERPRINT attribute at the end of data.
+func checkFingerprint(data []byte) bool {
+	off := len(data) - fingerprintSize
+	if off < headerLen || binary.BigEndian.Uint16(data[off+2:]) != 4 {
+		return false
+	}
+	crc := crc32.ChecksumIEEE(data[:off]) ^ fingerprintXor
+	return binary.BigEndian.Uint32(data[off+4:]) == crc
+}
+
+// ShortTermKey returns the MESSAGE-INTEGRITY key of the short-term credential
+// mechanism, which is the password itself.
+func ShortTermKey(password string) []byte {
+	return []byte(password)
+}
+
+func (m *Message) xorKey() [16]byte {
+	var key [16]byte
+	binary.BigEndian.PutUint32(key[:], magic)
+	copy(key[4:], m.TransacrtonId[:])
+	return key
+}
+
+// The encoders below append to a buffer, they don't allocate when it has
+// enough capacity.
+
+// extend grows b by n zero bytes and returns the new bytes as well.
+func extend(b []byte, n int) ([]byte, []byte) {
+	l := len(b)
+	b = append(b, make([]byte, n)...)
+	return b, b[l:]
+}
+
+// appendHeader appends h with a zero length, see setLength.
+func appendHeader(b []byte, h *header) []byte {
+	b, v := extend(b, headerLen)
+	binary.BigEndian.PutUint16(v[0:], h.Type)
+	binary.BigEndian.PutUint32(v[4:], h.Magic)
+	copy(v[8:], h.TransacrtonId[:])
+	return b
+}
+
+// setLength writes the length of msg, which starts with its header, into the
+// header and returns it.
+func setLength(msg []byte) uint16 {
+	l := uint16(len(msg) - headerLen)
+	binary.BigEndian.PutUint16(msg[2:], l)
+	return l
+}
+
+func appendAttr(b []byte, t uint16, value []byte) []byte {
+	b, v := extend(b, 4+padLen(len(value)))
+	binary.BigEndian.PutUint16(v[0:], t)
+	binary.BigEndian.PutUint16(v[2:], uint16(len(value)))
+	copy(v[4:], value)
+	return b
+}
+
+// appendString appends a text attribute, without converting s to []byte.
+func appendString(b []byte, t uint16, s string) []byte {
+	b, v := extend(b, 4+padLen(len(s)))
+	binary.BigEndian.PutUint16(v[0:], t)
+	binary.BigEndian.PutUint16(v[2:], uint16(len(s)))
+	copy(v[4:], s)
+	return b
+}
+
+func appendChangeRequest(b []byte, changeIp, changePort bool) []byte {
+	b, v := extend(b, 8)
+	binary.BigEndian.PutUint16(v[0:], AttrChangeRequest)
+	binary.BigEndian.PutUint16(v[2:], 4)
+	binary.BigEndian.PutUint32(v[4:], changeReqestValue(changeIp, changePort))
+	return b
+}
+
+// appendAddress appends a MAPPED-ADDRESS style attribute, XOR-ed with key
+// unless key is nil.
+func appendAddress(b []byte, t uint16, addr *net.UDPAddr, key *[16]byte) []byte {
+	family, ip := byte(attrAddressFieldIpv4), addr.IP.To4()
+	if ip == nil {
+		if family, ip = attrAddressFieldIpv6, addr.IP.To16(); ip == nil {
+			ip = net.IPv6unspecified
+		}
+	}
+
+	b, v := extend(b, 8+len(ip))
+	binary.BigEndian.PutUint16(v[0:], t)
+	binary.BigEndian.PutUint16(v[2:], uint16(4+len(ip)))
+	v[5] = family
+	copy(v[8:], ip)
+	port := uint16(addr.Port)
+	if key != nil {
+		port ^= magic >> 16
+		for i := range ip {
+			v[8+i] ^= key[i]
+		}
+	}
+	binary.BigEndian.PutUint16(v[6:], port)
+	return b
+}
+
+func appendErrorCode(b []byte, code int, reason string) []byte {
+	b, v := extend(b, 8+padLen(len(reason)))
+	binary.BigEndian.PutUint16(v[0:], AttrErrCode)
+	binary.BigEndian.PutUint16(v[2:], uint16(4+len(reason)))
+	v[6] = byte(code / 100)
+	v[7] = byte(code % 100)
+	copy(v[8:], reason)
+	return b
+}
+
+// appendIntegrity appends the MESSAGE-INTEGRITY attribute of the message
+// starting at b[start:], its length is updated to include the attribute.
+func appendIntegrity(b []byte, start int, key []byte) []byte {
+	b, v := extend(b, 4+sha1.Size)
+	binary.BigEndian.PutUint16(v[0:], AttrIntegrity)
+	binary.BigEndian.PutUint16(v[2:], sha1.Size)
+	setLength(b[start:])
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(b[start : len(b)-len(v)])
+	mac.Sum(v[4:4])
+	return b
+}
+
+// appendFingerprint appends the FINGERPRINT attribute of the message starting
+// at b[start:], its length is updated to include the attribute.
+func appendFingerprint(b []byte, start int) []byte {
+	b, v := extend(b, fingerprintSize)
+	binary.BigEndian.PutUint16(v[0:], AttrFingerprint)
+	binary.BigEndian.PutUint16(v[2:], 4)
+	setLength(b[start:])
+
+	crc := crc32.ChecksumIEEE(b[start:len(b)-fingerprintSize]) ^ fingerprintXor
+	binary.BigEndian.PutUint32(v[4:], crc)
+	return b
+}
+
+func padLen(l int) int {
+	return (l + 3) &^ 3
+}
@@ -0,0 +1,160 @@
+package stun
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestXorAddressRFC5769(t *testing.T) {
+	cases := []struct {
+		name string
+		data []byte
+		addr *net.UDPAddr
+	}{
+		{"ipv4", rfc5769ResponseIPv4, &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 32853}},
+		{"ipv6", rfc5769ResponseIPv6, &net.UDPAddr{IP: net.ParseIP("2001:db8:1234:5678:11:2233:4455:6677"), Port: 32853}},
+	}
+	for _, c := range cases {
+		var resp StunMessageResp
+		if err := resp.Unmarshal(c.data); err != nil {
+			t.Fatalf("%s: %s", c.name, err)
+		}
+		if !resp.Addr.IP.Equal(c.addr.IP) || resp.Addr.Port != c.addr.Port {
+			t.Errorf("%s: decoded %s, want %s", c.name, resp.Addr, c.addr)
+		}
+
+		// encoding the address again gives the attribute of the vector
+		want, _ := resp.Get(AttrXorAddress)
+		msg := NewMessage(ClassResponseSuccess, MethodBinding, resp.TransacrtonId[:])
+		msg.SetXorAddress(AttrXorAddress, c.addr)
+		if got, _ := msg.Get(AttrXorAddress); !bytes.Equal(got, want) {
+			t.Errorf("%s: encoded % x, want % x", c.name, got, want)
+		}
+	}
+}
+
+func TestXorAddressRoundTrip(t *testing.T) {
+	addrs := []*net.UDPAddr{
+		{IP: net.ParseIP("192.0.2.1"), Port: 32853},
+		{IP: net.ParseIP("255.255.255.255"), Port: 65535},
+		{IP: net.ParseIP("2001:db8::1"), Port: 3478},
+		{IP: net.ParseIP("2001:db8:1234:5678:11:2233:4455:6677"), Port: 1},
+		{IP: net.ParseIP("ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff"), Port: 0},
+		{IP: net.ParseIP("::ffff:192.0.2.1"), Port: 80},
+	}
+	for i := 0; i < 8; i++ {
+		req := NewBindRequest(nil)
+		for _, addr := range addrs {
+			resp := req.NewResponse(addr, nil)
+			data := resp.Marshal()
+
+			var got StunMessageResp
+			if err := got.Unmarshal(data); err != nil {
+				t.Fatalf("%s: %s", addr, err)
+			}
+			if !got.Addr.IP.Equal(addr.IP) || got.Addr.Port != addr.Port {
+				t.Errorf("%s: XOR-MAPPED-ADDRESS decoded as %s", addr, got.Addr)
+			}
+			mapped, err := got.GetAddress(AttrAddress)
+			if err != nil || !mapped.IP.Equal(addr.IP) || mapped.Port != addr.Port {
+				t.Errorf("%s: MAPPED-ADDRESS decoded as %s, %v", addr, mapped, err)
+			}
+
+			// the XORed value must not be the plain address for an IPv6 client
+			if addr.IP.To4() == nil {
+				xored, _ := got.Get(AttrXorAddress)
+				plain, _ := got.Get(AttrAddress)
+				if bytes.Equal(xored[4:], plain[4:]) {
+					t.Errorf("%s: address is not XORed", addr)
+				}
+			}
+		}
+	}
+}
+
+func TestIsMessageFingerprintInValue(t *testing.T) {
+	// the value of SOFTWARE ends like a FINGERPRINT attribute
+	msg := NewMessage(ClassIndication, MethodBinding, nil)
+	msg.Add(AttrSoftware, []byte{0x00, 0x00, 0x00, 0x00, 0x80, 0x28, 0x00, 0x04, 0xde, 0xad, 0xbe, 0xef})
+	data := msg.Marshal()
+	if !IsMessage(data) {
+		t.Error("message rejected by IsMessage")
+	}
+	if err := msg.Unmarshal(data); err != nil {
+		t.Error(err)
+	}
+
+	msg.AddFingerprint()
+	data = msg.Marshal()
+	data[len(data)-1] ^= 0x01
+	if IsMessage(data) {
+		t.Error("bad fingerprint accepted by IsMessage")
+	}
+}
+
+func TestMessageAttributes(t *testing.T) {
+	msg := NewMessage(ClassRequest, MethodBinding, nil)
+	value := []byte("go-stun")
+	msg.Add(AttrSoftware, value)
+	value[0] = 'x'
+	msg.Add(0x8055, []byte{0x01})
+	msg.Add(0x8055, []byte{0x02, 0x03})
+	msg.SetChangeRequest(true, false)
+
+	if v, ok := msg.Get(AttrSoftware); !ok || string(v) != "go-stun" {
+		t.Errorf("SOFTWARE %q %v, the value must be copied", v, ok)
+	}
+	if values := msg.GetAll(0x8055); len(values) != 2 || !bytes.Equal(values[0], []byte{0x01}) || !bytes.Equal(values[1], []byte{0x02, 0x03}) {
+		t.Errorf("GetAll %v", values)
+	}
+	if _, ok := msg.Get(AttrRealm); ok {
+		t.Error("missing attribute found")
+	}
+
+	// unknown attributes and their order survive a round trip
+	var got Message
+	if err := got.Unmarshal(msg.Marshal()); err != nil {
+		t.Fatal(err)
+	}
+	if got.Class() != ClassRequest || got.Method() != MethodBinding || got.TransacrtonId != msg.TransacrtonId {
+		t.Errorf("header %+v", got.header)
+	}
+	if len(got.Attributes) != len(msg.Attributes) {
+		t.Fatalf("attributes %v", got.Attributes)
+	}
+	for i, a := range got.Attributes {
+		if a.Type != msg.Attributes[i].Type || !bytes.Equal(a.Value, msg.Attributes[i].Value) {
+			t.Errorf("attribute %d: %+v, want %+v", i, a, msg.Attributes[i])
+		}
+	}
+	if changeIP, changePort, err := got.GetChangeRequest(); err != nil || !changeIP || changePort {
+		t.Errorf("CHANGE-REQUEST %v %v %v", changeIP, changePort, err)
+	}
+
+	got.Remove(0x8055)
+	if len(got.GetAll(0x8055)) != 0 || len(got.Attributes) != 2 {
+		t.Errorf("after Remove %v", got.Attributes)
+	}
+
+	// the attributes the requests don't decode are kept
+	var req StunMessageReq
+	if err := req.Unmarshal(msg.Marshal()); err != nil {
+		t.Fatal(err)
+	}
+	if !req.ChangeIp || req.ChangePort || len(req.GetAll(0x8055)) != 2 {
+		t.Errorf("request %+v", req)
+	}
+}
+
+func TestMessageMalformed(t *testing.T) {
+	data := NewMessage(ClassRequest, MethodBinding, nil).Marshal()
+	data = append(data, 0x80, 0x22, 0x00, 0x08, 'a', 'b')
+	data[3] = 8
+	for _, b := range [][]byte{data[:10], data[:headerLen+4], data} {
+		var msg Message
+		if err := msg.Unmarshal(b); err == nil {
+			t.Errorf("% x accepted", b)
+		}
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !linux && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd
+
+package stun
+
+import (
+	"errors"
+	"net"
+)
+
+// ListenReusePort is like net.ListenUDP, with SO_REUSEPORT set on the socket,
+// which is not supported on this platform.
+func ListenReusePort(network string, laddr *net.UDPAddr) (*net.UDPConn, error) {
+	return nil, errors.New("SO_REUSEPORT is not supported on this platform")
+}
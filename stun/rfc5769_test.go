@@ -0,0 +1,208 @@
+package stun
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"net"
+	"strings"
+	"testing"
+)
+
+// The test vectors of RFC 5769.
+
+const rfc5769Password = "VOkJxbRl1RmTxUk/WvJxBt"
+
+// sample request, section 2.1
+var rfc5769Request = unhex(`
+	00 01 00 58 21 12 a4 42 b7 e7 a7 01 bc 34 d6 86 fa 87 df ae
+	80 22 00 10 53 54 55 4e 20 74 65 73 74 20 63 6c 69 65 6e 74
+	00 24 00 04 6e 00 01 ff
+	80 29 00 08 93 2f f9 b1 51 26 3b 36
+	00 06 00 09 65 76 74 6a 3a 68 36 76 59 20 20 20
+	00 08 00 14 9a ea a7 0c bf d8 cb 56 78 1e f2 b5 b2 d3 f2 49 c1 b5 71 a2
+	80 28 00 04 e5 7a 3b cf`)
+
+// sample IPv4 response, section 2.2: 192.0.2.1:32853
+var rfc5769ResponseIPv4 = unhex(`
+	01 01 00 3c 21 12 a4 42 b7 e7 a7 01 bc 34 d6 86 fa 87 df ae
+	80 22 00 0b 74 65 73 74 20 76 65 63 74 6f 72 20
+	00 20 00 08 00 01 a1 47 e1 12 a6 43
+	00 08 00 14 2b 91 f5 99 fd 9e 90 c3 8c 74 89 f9 2a f9 ba 53 f0 6b e7 d7
+	80 28 00 04 c0 7d 4c 96`)
+
+// sample IPv6 response, section 2.3: [2001:db8:1234:5678:11:2233:4455:6677]:32853
+var rfc5769ResponseIPv6 = unhex(`
+	01 01 00 48 21 12 a4 42 b7 e7 a7 01 bc 34 d6 86 fa 87 df ae
+	80 22 00 0b 74 65 73 74 20 76 65 63 74 6f 72 20
+	00 20 00 14 00 02 a1 47 01 13 a9 fa a5 d3 f1 79 bc 25 f4 b5 be d2 b9 d9
+	00 08 00 14 a3 82 95 4e 4b e6 7b f1 17 84 c9 7c 82 92 c2 75 bf e3 ed 41
+	80 28 00 04 c8 fb 0b 4c`)
+
+// sample request with long-term authentication, section 2.4
+var rfc5769LongTermRequest = unhex(`
+	00 01 00 60 21 12 a4 42 78 ad 34 33 c6 ad 72 c0 29 da 41 2e
+	00 06 00 12 e3 83 9e e3 83 88 e3 83 aa e3 83 83 e3 82 af e3 82 b9 00 00
+	00 15 00 1c 66 2f 2f 34 39 39 6b 39 35 34 64 36 4f 4c 33 34 6f 4c 39 46 53 54 76 79 36 34 73 41
+	00 14 00 0b 65 78 61 6d 70 6c 65 2e 6f 72 67 00
+	00 08 00 14 f6 70 24 65 6d d6 4a 3e 02 b8 e0 71 2e 85 c9 a2 8c a8 96 66`)
+
+func unhex(s string) []byte {
+	b, err := hex.DecodeString(strings.Join(strings.Fields(s), ""))
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// ICE-CONTROLLED, RFC 5245, carried by the sample request
+const attrIceControlled = 0x8029
+
+func TestRFC5769Request(t *testing.T) {
+	var req StunMessageReq
+	if err := req.Unmarshal(rfc5769Request); err != nil {
+		t.Fatal(err)
+	}
+	if req.Class() != ClassRequest || req.Method() != MethodBinding {
+		t.Errorf("type %#04x, want a Binding request", req.Type)
+	}
+	if req.Username != "evtj:h6vY" {
+		t.Errorf("username %q", req.Username)
+	}
+	if software, _ := req.GetString(AttrSoftware); software != "STUN test client" {
+		t.Errorf("software %q", software)
+	}
+	if !req.Fingerprint {
+		t.Error("fingerprint not reported")
+	}
+	if err := req.CheckShortTermCredentials(rfc5769Password); err != nil {
+		t.Error("integrity: ", err)
+	}
+	if err := req.CheckShortTermCredentials("wrong"); err != ErrIntegrityMismatch {
+		t.Errorf("integrity with a wrong password: %v", err)
+	}
+
+	msg := NewMessage(ClassRequest, MethodBinding, req.TransacrtonId[:])
+	msg.SetString(AttrSoftware, "STUN test client")
+	msg.Add(AttrPriority, []byte{0x6e, 0x00, 0x01, 0xff})
+	msg.Add(attrIceControlled, []byte{0x93, 0x2f, 0xf9, 0xb1, 0x51, 0x26, 0x3b, 0x36})
+	msg.SetString(AttrUsername, "evtj:h6vY")
+	checkBytes(t, "request", vectorBytes(msg, ' ', ShortTermKey(rfc5769Password), true), rfc5769Request)
+}
+
+func TestRFC5769Responses(t *testing.T) {
+	cases := []struct {
+		name string
+		data []byte
+		addr *net.UDPAddr
+	}{
+		{"ipv4", rfc5769ResponseIPv4, &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 32853}},
+		{"ipv6", rfc5769ResponseIPv6, &net.UDPAddr{IP: net.ParseIP("2001:db8:1234:5678:11:2233:4455:6677"), Port: 32853}},
+	}
+	for _, c := range cases {
+		var resp StunMessageResp
+		if err := resp.Unmarshal(c.data); err != nil {
+			t.Fatalf("%s: %s", c.name, err)
+		}
+		if resp.Class() != ClassResponseSuccess || resp.ErrorCode != 0 {
+			t.Errorf("%s: type %#04x, error code %d", c.name, resp.Type, resp.ErrorCode)
+		}
+		if !resp.Fingerprint {
+			t.Errorf("%s: fingerprint not reported", c.name)
+		}
+		if err := resp.CheckIntegrity(ShortTermKey(rfc5769Password)); err != nil {
+			t.Errorf("%s: integrity: %s", c.name, err)
+		}
+		if software, _ := resp.GetString(AttrSoftware); software != "test vector" {
+			t.Errorf("%s: software %q", c.name, software)
+		}
+
+		msg := NewMessage(ClassResponseSuccess, MethodBinding, resp.TransacrtonId[:])
+		msg.SetString(AttrSoftware, "test vector")
+		msg.SetXorAddress(AttrXorAddress, c.addr)
+		checkBytes(t, c.name, vectorBytes(msg, ' ', ShortTermKey(rfc5769Password), true), c.data)
+	}
+}
+
+func TestRFC5769LongTermRequest(t *testing.T) {
+	// the password is "The\u00adM\u00aatr\u2168" in the RFC, SASLprep gives
+	// "TheMatrIX"
+	username := "\u30de\u30c8\u30ea\u30c3\u30af\u30b9"
+	realm := "example.org"
+	nonce := "f//499k954d6OL34oL9FSTvy64sA"
+	key := LongTermKey(username, realm, "TheMatrIX")
+
+	var req StunMessageReq
+	if err := req.Unmarshal(rfc5769LongTermRequest); err != nil {
+		t.Fatal(err)
+	}
+	if req.Username != username {
+		t.Errorf("username %q", req.Username)
+	}
+	if s, _ := req.GetString(AttrRealm); s != realm {
+		t.Errorf("realm %q", s)
+	}
+	if s, _ := req.GetString(AttrNonce); s != nonce {
+		t.Errorf("nonce %q", s)
+	}
+	if req.Fingerprint {
+		t.Error("fingerprint reported")
+	}
+	if err := req.CheckIntegrity(key); err != nil {
+		t.Error("integrity: ", err)
+	}
+
+	msg := NewMessage(ClassRequest, MethodBinding, req.TransacrtonId[:])
+	msg.SetString(AttrUsername, username)
+	msg.SetString(AttrNonce, nonce)
+	msg.SetString(AttrRealm, realm)
+	checkBytes(t, "long-term request", vectorBytes(msg, 0, key, false), rfc5769LongTermRequest)
+}
+
+// TestRFC5769Tampered checks that a flipped bit anywhere in a sample message
+// is caught by MESSAGE-INTEGRITY or FINGERPRINT. The type of the FINGERPRINT
+// attribute is left alone: flipped, it is an unknown attribute following
+// MESSAGE-INTEGRITY, which receivers ignore.
+func TestRFC5769Tampered(t *testing.T) {
+	for _, vector := range [][]byte{rfc5769Request, rfc5769ResponseIPv4, rfc5769ResponseIPv6} {
+		for i := headerLen; i < len(vector); i++ {
+			if i == len(vector)-fingerprintSize || i == len(vector)-fingerprintSize+1 {
+				continue
+			}
+			data := append([]byte(nil), vector...)
+			data[i] ^= 0x01
+
+			var msg Message
+			if err := msg.Unmarshal(data); err == nil {
+				if msg.CheckIntegrity(ShortTermKey(rfc5769Password)) == nil {
+					t.Errorf("byte %d flipped, message accepted", i)
+				}
+			}
+		}
+	}
+}
+
+// vectorBytes encodes msg as the vectors do, with their padding bytes, then
+// appends its MESSAGE-INTEGRITY with key and its FINGERPRINT.
+func vectorBytes(msg *Message, pad byte, key []byte, fingerprint bool) []byte {
+	b := msg.Marshal()
+	for off := headerLen; off < len(b); {
+		l := int(binary.BigEndian.Uint16(b[off+2:]))
+		for i := off + 4 + l; i < off+4+padLen(l); i++ {
+			b[i] = pad
+		}
+		off += 4 + padLen(l)
+	}
+	b = appendIntegrity(b, 0, key)
+	if fingerprint {
+		b = appendFingerprint(b, 0)
+	}
+	return b
+}
+
+func checkBytes(t *testing.T, name string, got, want []byte) {
+	t.Helper()
+	if !bytes.Equal(got, want) {
+		t.Errorf("%s: generated\n% x\nwant\n% x", name, got, want)
+	}
+}
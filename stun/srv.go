@@ -0,0 +1,91 @@
+package stun
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Resolver looks up the SRV records of STUN servers, *net.Resolver is one.
+type Resolver interface {
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+}
+
+// DefaultResolver is the resolver of Request and nat.Discovery.
+var DefaultResolver Resolver = net.DefaultResolver
+
+var ErrNoServer = errors.New("stun service is not available in this domain")
+
+// LookupServers returns the host:port addresses to try in order to reach the
+// server of u. As described in RFC 5389 section 9, a domain without port is
+// looked up in the _stun._udp, _stun._tcp or _stuns._tcp SRV records matching
+// the transport of u, ordered by priority and weight, falling back to its
+// A/AAAA records on the default port when it has no SRV records.
+func LookupServers(ctx context.Context, resolver Resolver, u *URI) ([]string, error) {
+	if u.Port != 0 || net.ParseIP(u.Host) != nil {
+		return []string{u.Addr()}, nil
+	}
+
+	service := "stun"
+	if u.Secure() {
+		service = "stuns"
+	}
+	_, records, err := resolver.LookupSRV(ctx, service, u.Network(), u.Host)
+	if err != nil || len(records) == 0 {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return []string{u.Addr()}, nil
+	}
+	if len(records) == 1 && records[0].Target == "." {
+		return nil, ErrNoServer
+	}
+
+	orderSRV(records)
+	servers := make([]string, 0, len(records))
+	for _, r := range records {
+		host := strings.TrimSuffix(r.Target, ".")
+		servers = append(servers, net.JoinHostPort(host, strconv.Itoa(int(r.Port))))
+	}
+	return servers, nil
+}
+
+// orderSRV sorts the records by priority, and shuffles the records of the
+// same priority by weight, RFC 2782.
+func orderSRV(records []*net.SRV) {
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].Priority < records[j].Priority
+	})
+
+	i := 0
+	for j := 1; j <= len(records); j++ {
+		if j == len(records) || records[j].Priority != records[i].Priority {
+			shuffleByWeight(records[i:j])
+			i = j
+		}
+	}
+}
+
+func shuffleByWeight(records []*net.SRV) {
+	sum := 0
+	for _, r := range records {
+		sum += int(r.Weight)
+	}
+	for sum > 0 && len(records) > 1 {
+		s := 0
+		n := rand.Intn(sum)
+		for i := range records {
+			s += int(records[i].Weight)
+			if s > n {
+				records[0], records[i] = records[i], records[0]
+				break
+			}
+		}
+		sum -= int(records[0].Weight)
+		records = records[1:]
+	}
+}
@@ -0,0 +1,144 @@
+package stun
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// fakeResolver answers SRV queries from a table keyed by _service._proto.name.
+type fakeResolver map[string][]*net.SRV
+
+func (r fakeResolver) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	cname := "_" + service + "._" + proto + "." + name
+	records, ok := r[cname]
+	if !ok {
+		return "", nil, &net.DNSError{Err: "no such host", Name: cname, IsNotFound: true}
+	}
+	// hand out a copy, LookupServers reorders the records
+	return cname, append([]*net.SRV(nil), records...), nil
+}
+
+func TestLookupServers(t *testing.T) {
+	resolver := fakeResolver{
+		"_stun._udp.example.org": {
+			{Target: "c.example.org.", Port: 3480, Priority: 20},
+			{Target: "a.example.org.", Port: 3478, Priority: 10},
+			{Target: "b.example.org.", Port: 3479, Priority: 15},
+		},
+		"_stun._tcp.example.org": {
+			{Target: "tcp.example.org.", Port: 3478, Priority: 10},
+		},
+		"_stuns._tcp.example.org": {
+			{Target: "tls.example.org.", Port: 443, Priority: 10},
+		},
+		"_stun._udp.disabled.org": {
+			{Target: ".", Port: 0},
+		},
+	}
+
+	cases := []struct {
+		server  string
+		servers []string
+		err     error
+	}{
+		{"example.org", []string{"a.example.org:3478", "b.example.org:3479", "c.example.org:3480"}, nil},
+		{"stun:example.org", []string{"a.example.org:3478", "b.example.org:3479", "c.example.org:3480"}, nil},
+		{"stun:example.org?transport=tcp", []string{"tcp.example.org:3478"}, nil},
+		{"stuns:example.org", []string{"tls.example.org:443"}, nil},
+		{"example.org:3478", []string{"example.org:3478"}, nil},
+		{"stun:192.0.2.1", []string{"192.0.2.1:3478"}, nil},
+		{"stuns:nosrv.org", []string{"nosrv.org:5349"}, nil},
+		{"disabled.org", nil, ErrNoServer},
+	}
+	for _, c := range cases {
+		u, err := ParseServer(c.server)
+		if err != nil {
+			t.Fatalf("%s: %s", c.server, err)
+		}
+		servers, err := LookupServers(context.Background(), resolver, u)
+		if err != c.err {
+			t.Errorf("%s: error %v, want %v", c.server, err, c.err)
+		}
+		if !reflect.DeepEqual(servers, c.servers) {
+			t.Errorf("%s: servers %v, want %v", c.server, servers, c.servers)
+		}
+	}
+}
+
+func TestOrderSRVWeight(t *testing.T) {
+	// a record of weight 0 comes after the weighted ones of its priority
+	for i := 0; i < 20; i++ {
+		records := []*net.SRV{
+			{Target: "zero", Priority: 1, Weight: 0},
+			{Target: "heavy", Priority: 1, Weight: 100},
+			{Target: "last", Priority: 2, Weight: 100},
+		}
+		orderSRV(records)
+		if records[0].Target != "heavy" || records[1].Target != "zero" || records[2].Target != "last" {
+			t.Fatalf("bad order %s %s %s", records[0].Target, records[1].Target, records[2].Target)
+		}
+	}
+}
+
+func TestRequestSRVFailover(t *testing.T) {
+	// the first server never answers, the request falls over to the second
+	dead, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dead.Close()
+	alive, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer alive.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, remote, err := alive.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			var req StunMessageReq
+			if req.Unmarshal(buf[:n]) == nil {
+				req.RespondTo(alive, remote, nil)
+			}
+		}
+	}()
+
+	srv := func(conn *net.UDPConn, priority uint16) *net.SRV {
+		return &net.SRV{Target: "127.0.0.1.", Port: uint16(conn.LocalAddr().(*net.UDPAddr).Port), Priority: priority}
+	}
+	defer func(r Resolver) { DefaultResolver = r }(DefaultResolver)
+	DefaultResolver = fakeResolver{
+		"_stun._udp.example.org": {srv(alive, 2), srv(dead, 1)},
+	}
+
+	req := NewBindRequest(nil)
+	req.Options = &ClientOptions{RTO: 20 * time.Millisecond, Rc: 2, Rm: 2}
+	resp, _, err := req.Request("127.0.0.1:0", "stun:example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Addr == nil {
+		t.Fatal("no mapped address")
+	}
+
+	// without any server answering, the last error is returned
+	DefaultResolver = fakeResolver{
+		"_stun._udp.example.org": {srv(dead, 1)},
+	}
+	_, _, err = req.Request("127.0.0.1:0", "example.org")
+	if !errors.Is(err, ErrTimeout) {
+		t.Fatalf("error %v, want %v", err, ErrTimeout)
+	}
+
+	if _, _, err = req.Request("127.0.0.1:0", "stuns:example.org:"+strconv.Itoa(DefaultTLSPort)); err == nil {
+		t.Fatal("stuns: server accepted over udp")
+	}
+}
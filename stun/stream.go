@@ -0,0 +1,181 @@
+package stun
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"time"
+)
+
+// ReadMessage reads one STUN message from a stream, messages are framed by
+// the length field of their header, RFC 5389 section 7.2.2.
+func ReadMessage(r io.Reader) ([]byte, error) {
+	hdr := make([]byte, headerLen)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, err
+	}
+	if hdr[0]&0xc0 != 0 || binary.BigEndian.Uint32(hdr[4:]) != magic {
+		return nil, ErrMalformedMessage
+	}
+
+	data := make([]byte, headerLen+int(binary.BigEndian.Uint16(hdr[2:])))
+	copy(data, hdr)
+	if _, err := io.ReadFull(r, data[headerLen:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return data, nil
+}
+
+// RequestStream sends req over a stream connection such as TCP and waits
+// for its response. Requests are not retransmitted over a reliable transport.
+func (req *StunMessageReq) RequestStream(conn net.Conn) (*StunMessageResp, error) {
+	return req.RequestStreamContext(context.Background(), conn)
+}
+
+func (req *StunMessageReq) RequestStreamContext(ctx context.Context, conn net.Conn) (*StunMessageResp, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	defer abortOnDone(ctx, conn.SetReadDeadline)()
+
+	for retry := 0; retry < maxChallenges; retry++ {
+		if retry > 0 {
+			if err := req.newTransaction(); err != nil {
+				return nil, err
+			}
+		}
+
+		resp, err := req.transactStream(ctx, conn)
+		if err != nil {
+			return nil, err
+		}
+		if err = req.checkResponse(resp); err == errChallenge {
+			continue
+		} else if err != nil {
+			return resp, err
+		}
+		return resp, nil
+	}
+
+	return nil, errRetryExceeded
+}
+
+func (req *StunMessageReq) transactStream(ctx context.Context, conn net.Conn) (*StunMessageResp, error) {
+	if _, err := conn.Write(req.Marshal()); err != nil {
+		return nil, err
+	}
+
+	if err := conn.SetReadDeadline(time.Now().Add(req.options().Ti)); err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	for {
+		data, err := ReadMessage(conn)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			if err, ok := err.(net.Error); ok && err.Timeout() {
+				return nil, ErrTimeout
+			}
+			return nil, err
+		}
+
+		var resp StunMessageResp
+		if resp.Unmarshal(data) != nil || resp.TransacrtonId != req.TransacrtonId {
+			continue
+		}
+		return &resp, nil
+	}
+}
+
+// RequestTCP sends req to remoteAddr over a new TCP connection from
+// localAddr, it returns the response and the local address of the connection.
+func (req *StunMessageReq) RequestTCP(localAddr, remoteAddr string) (*StunMessageResp, *net.TCPAddr, error) {
+	return req.RequestTCPContext(context.Background(), localAddr, remoteAddr)
+}
+
+func (req *StunMessageReq) RequestTCPContext(ctx context.Context, localAddr, remoteAddr string) (*StunMessageResp, *net.TCPAddr, error) {
+	dialer, err := tcpDialer(localAddr)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	conn, err := dialer.DialContext(ctx, "tcp", remoteAddr)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer conn.Close()
+
+	resp, err := req.RequestStreamContext(ctx, conn)
+	return resp, conn.LocalAddr().(*net.TCPAddr), err
+}
+
+// RequestTLS is like RequestTCP over TLS, the stuns: transport. When
+// config.ServerName is empty the certificate of the server is verified
+// against the host of remoteAddr.
+func (req *StunMessageReq) RequestTLS(localAddr, remoteAddr string, config *tls.Config) (*StunMessageResp, *net.TCPAddr, error) {
+	return req.RequestTLSContext(context.Background(), localAddr, remoteAddr, config)
+}
+
+func (req *StunMessageReq) RequestTLSContext(ctx context.Context, localAddr, remoteAddr string, config *tls.Config) (*StunMessageResp, *net.TCPAddr, error) {
+	dialer, err := tcpDialer(localAddr)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tlsDialer := tls.Dialer{NetDialer: dialer, Config: config}
+	conn, err := tlsDialer.DialContext(ctx, "tcp", remoteAddr)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer conn.Close()
+
+	resp, err := req.RequestStreamContext(ctx, conn)
+	return resp, conn.LocalAddr().(*net.TCPAddr), err
+}
+
+func tcpDialer(localAddr string) (*net.Dialer, error) {
+	var dialer net.Dialer
+	if localAddr != "" {
+		local, err := net.ResolveTCPAddr("tcp", localAddr)
+		if err != nil {
+			return nil, err
+		}
+		dialer.LocalAddr = local
+	}
+	return &dialer, nil
+}
+
+// RespondStream answers req on the stream connection it was received on,
+// with the address of the peer as the mapped address.
+func (req *StunMessageReq) RespondStream(conn net.Conn, other *net.UDPAddr) error {
+	resp := req.NewResponse(streamAddr(conn.RemoteAddr()), other)
+	_, err := conn.Write(resp.Marshal())
+	return err
+}
+
+func (req *StunMessageReq) RespondStreamError(conn net.Conn, code int, reason string) error {
+	_, err := conn.Write(req.NewErrorResponse(code, reason).Marshal())
+	return err
+}
+
+// streamAddr converts the address of a stream peer, the mapped addresses
+// of the responses are UDPAddr whatever the transport.
+func streamAddr(addr net.Addr) *net.UDPAddr {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return &net.UDPAddr{IP: a.IP, Port: a.Port, Zone: a.Zone}
+	case *net.UDPAddr:
+		return a
+	}
+	udpAddr, _ := net.ResolveUDPAddr("udp", addr.String())
+	return udpAddr
+}
@@ -0,0 +1,131 @@
+package stun
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"github.com/pion/dtls/v2/pkg/crypto/selfsign"
+	"io"
+	"testing"
+	"testing/iotest"
+)
+
+func TestReadMessage(t *testing.T) {
+	first := NewBindRequest(nil).Marshal()
+	req := NewBindRequest(nil)
+	req.Add(AttrSoftware, []byte("go-stun"))
+	second := req.Marshal()
+	stream := append(append([]byte(nil), first...), second...)
+
+	// messages read a byte at a time keep their framing
+	r := iotest.OneByteReader(bytes.NewReader(stream))
+	for i, want := range [][]byte{first, second} {
+		data, err := ReadMessage(r)
+		if err != nil || !bytes.Equal(data, want) {
+			t.Fatalf("message %d: % x %v", i, data, err)
+		}
+	}
+	if _, err := ReadMessage(r); err != io.EOF {
+		t.Errorf("end of stream: %v, want EOF", err)
+	}
+
+	badMagic := append([]byte(nil), first...)
+	badMagic[4] ^= 0xff
+	for _, c := range []struct {
+		name string
+		data []byte
+		err  error
+	}{
+		{"partial header", first[:headerLen-1], io.ErrUnexpectedEOF},
+		{"header only", second[:headerLen], io.ErrUnexpectedEOF},
+		{"partial attribute", second[:len(second)-2], io.ErrUnexpectedEOF},
+		{"bad magic", badMagic, ErrMalformedMessage},
+		{"not stun", []byte("GET / HTTP/1.1\r\n\r\n\r\n"), ErrMalformedMessage},
+	} {
+		if _, err := ReadMessage(iotest.HalfReader(bytes.NewReader(c.data))); err != c.err {
+			t.Errorf("%s: %v, want %v", c.name, err, c.err)
+		}
+	}
+}
+
+// startTLSServer answers the Binding requests of TLS clients on the loopback
+// interface with a self-signed certificate for stun.example.org, it returns
+// the server address and the roots trusting it.
+func startTLSServer(t *testing.T) (string, *x509.CertPool) {
+	cert, err := selfsign.GenerateSelfSignedWithDNS("stun.example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				for {
+					data, err := ReadMessage(conn)
+					if err != nil {
+						return
+					}
+					var req StunMessageReq
+					if err = req.Unmarshal(data); err != nil {
+						t.Error("server unmarshal: ", err)
+						return
+					}
+					if err = req.RespondStream(conn, nil); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(leaf)
+	return l.Addr().String(), roots
+}
+
+func TestRequestTLS(t *testing.T) {
+	server, roots := startTLSServer(t)
+
+	req := NewBindRequest(nil)
+	resp, local, err := req.RequestTLS("127.0.0.1:0", server, &tls.Config{RootCAs: roots, ServerName: "stun.example.org"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Addr.String() != local.String() {
+		t.Errorf("mapped address %s, want %s", resp.Addr, local)
+	}
+	if resp.TransacrtonId != req.TransacrtonId {
+		t.Error("transaction ID mismatch")
+	}
+
+	for _, c := range []struct {
+		name   string
+		config *tls.Config
+	}{
+		{"unknown authority", &tls.Config{ServerName: "stun.example.org"}},
+		{"wrong server name", &tls.Config{RootCAs: roots, ServerName: "other.example.org"}},
+		// without ServerName the certificate is checked against 127.0.0.1
+		{"host of the address", &tls.Config{RootCAs: roots}},
+	} {
+		_, _, err := NewBindRequest(nil).RequestTLS("127.0.0.1:0", server, c.config)
+		var verifyErr *tls.CertificateVerificationError
+		if !errors.As(err, &verifyErr) {
+			t.Errorf("%s: %v, want a certificate verification error", c.name, err)
+		}
+	}
+}
@@ -1,14 +1,14 @@
 package stun
 
 import (
-	"bytes"
+	"context"
 	"crypto/rand"
 	"encoding/binary"
 	"errors"
 	"fmt"
-	"golang.org/x/net/ipv4"
 	"io"
 	"net"
+	"sync"
 	"time"
 )
 
@@ -45,47 +45,59 @@ type header struct {
 }
 
 type StunMessageReq struct {
-	header
+	Message
 
 	ChangeIp   bool
 	ChangePort bool
 	RespSource string
+	Username   string
 	//Candidate	interface{}
+
+	// Fingerprint makes Marshal append a FINGERPRINT attribute.
+	Fingerprint bool
+	// Options are the retransmission parameters, DefaultClientOptions if nil.
+	Options *ClientOptions
+
+	key      []byte
+	password string
+	realm    string
+	nonce    string
 }
 
 type StunMessageResp struct {
-	header
+	Message
 	Addr      *net.UDPAddr
 	OtherAddr *net.UDPAddr
 	ErrorCode uint16
 	ErrorMsg  string
-}
 
-type attrHeader struct {
-	Type   uint16
-	Length uint16
+	// Fingerprint makes Marshal append a FINGERPRINT attribute.
+	Fingerprint bool
+
+	key []byte
 }
 
 const (
 	// Comprehension required
-	attrAddress       = 0x01
-	attrChangeRequest = 0x03
-	attrUsername      = 0x06
-	attrIntegrity     = 0x08
-	attrErrCode       = 0x09
-	attrUnknownAttrs  = 0x0A
-	attrRealm         = 0x14
-	attrNonce         = 0x15
-	attrXorAddress    = 0x20
-	attrUseCandidate  = 0x25
-	attrPadding       = 0x26
-	attrResponsePort  = 0x27
+	AttrAddress       = 0x01
+	AttrChangeRequest = 0x03
+	AttrUsername      = 0x06
+	AttrIntegrity     = 0x08
+	AttrErrCode       = 0x09
+	AttrUnknownAttrs  = 0x0A
+	AttrRealm         = 0x14
+	AttrNonce         = 0x15
+	AttrXorAddress    = 0x20
+	AttrPriority      = 0x24
+	AttrUseCandidate  = 0x25
+	AttrPadding       = 0x26
+	AttrResponsePort  = 0x27
 
 	// Comprehension optional
-	attrSoftware = 0x8022
-	//attrAlternate   = 0x8023
-	attrFingerprint  = 0x8028
-	attrOtherAddress = 0x802c
+	AttrSoftware = 0x8022
+	//AttrAlternate   = 0x8023
+	AttrFingerprint  = 0x8028
+	AttrOtherAddress = 0x802c
 )
 
 const (
@@ -96,12 +108,22 @@ const (
 	errStaleNonce       = 438
 	errServerInternal   = 500
 )
+
+var errReasons = map[int]string{
+	errTryAlternate:     "Try Alternate",
+	errBadRequest:       "Bad Request",
+	errUnauthorized:     "Unauthorized",
+	errUnknownAttribute: "Unknown Attribute",
+	errStaleNonce:       "Stale Nonce",
+	errServerInternal:   "Server Error",
+}
+
 const (
-	classRequest = iota
-	classIndication
-	classResonseSuccess
-	classError
-	methodBinding = 1
+	ClassRequest = iota
+	ClassIndication
+	ClassResponseSuccess
+	ClassError
+	MethodBinding = 1
 )
 
 const (
@@ -117,10 +139,59 @@ const (
 	headerLen = 20
 )
 
+// ClientOptions are the retransmission parameters of a request over UDP,
+// RFC 5389 section 7.2.1: the request is sent Rc times, starting with a
+// timeout of RTO that doubles after each retransmission, and after the last
+// one the client waits Rm times the initial RTO for a response. Over a
+// stream the request is sent once and the response awaited for Ti.
+type ClientOptions struct {
+	RTO time.Duration
+	Rc  int
+	Rm  int
+	Ti  time.Duration
+}
+
+var DefaultClientOptions = ClientOptions{
+	RTO: 500 * time.Millisecond,
+	Rc:  7,
+	Rm:  16,
+	Ti:  39500 * time.Millisecond,
+}
+
 var (
-	magicBytes = []byte{0x21, 0x12, 0xa4, 0x42}
+	ErrTimeout = errors.New("stun request timed out")
+
+	errChallenge     = errors.New("stun request must answer a challenge")
+	errRetryExceeded = errors.New("request retry exceeds max times")
 )
 
+// maxChallenges bounds the authentication challenges a request answers.
+const maxChallenges = 3
+
+// UnknownAttributesError is returned by StunMessageReq.Unmarshal when the
+// request has comprehension-required attributes this package does not know.
+type UnknownAttributesError struct {
+	Attrs []uint16
+}
+
+func (e *UnknownAttributesError) Error() string {
+	return fmt.Sprintf("stun request has unknown comprehension-required attributes %#04x", e.Attrs)
+}
+
+func isKnownAttr(t uint16) bool {
+	if t >= 0x8000 {
+		// comprehension optional
+		return true
+	}
+	switch t {
+	case AttrAddress, AttrChangeRequest, AttrUsername, AttrIntegrity, AttrErrCode,
+		AttrUnknownAttrs, AttrRealm, AttrNonce, AttrXorAddress, AttrPriority,
+		AttrUseCandidate, AttrPadding, AttrResponsePort:
+		return true
+	}
+	return false
+}
+
 func changeReqestValue(changeIp, changePort bool) uint32 {
 	var v uint32
 	if changeIp {
@@ -133,190 +204,136 @@ func changeReqestValue(changeIp, changePort bool) uint32 {
 }
 
 func (req *StunMessageReq) Marshal() []byte {
-	var buf bytes.Buffer
-	binary.Write(&buf, binary.BigEndian, req.header)
-	binary.Write(&buf, binary.BigEndian, []interface{}{
-		uint16(attrChangeRequest),
-		uint16(4),
-		changeReqestValue(req.ChangeIp, req.ChangePort),
-	})
+	return req.AppendTo(nil)
+}
 
-	return buf.Bytes()
+// AppendTo appends the request in wire format to b, like Marshal, without
+// allocating when b has enough capacity.
+func (req *StunMessageReq) AppendTo(b []byte) []byte {
+	start := len(b)
+	b = appendHeader(b, &req.header)
+	b = appendChangeRequest(b, req.ChangeIp, req.ChangePort)
+	for _, a := range req.Attributes {
+		switch a.Type {
+		case AttrChangeRequest, AttrUsername, AttrRealm, AttrNonce, AttrIntegrity, AttrFingerprint:
+		default:
+			b = appendAttr(b, a.Type, a.Value)
+		}
+	}
+	if req.Username != "" {
+		b = appendString(b, AttrUsername, req.Username)
+	}
+	if req.realm != "" {
+		b = appendString(b, AttrRealm, req.realm)
+		b = appendString(b, AttrNonce, req.nonce)
+	}
+	if req.key != nil {
+		b = appendIntegrity(b, start, req.key)
+	}
+	if req.Fingerprint {
+		b = appendFingerprint(b, start)
+	}
+	req.Length = setLength(b[start:])
+	return b
 }
 
 func (req *StunMessageReq) Unmarshal(data []byte) error {
-	if err := binary.Read(bytes.NewBuffer(data[:headerLen]), binary.BigEndian, &req.header); err != nil {
+	// the credentials of a former request must not leak into this one
+	*req = StunMessageReq{Message: req.Message}
+	if err := req.Message.Unmarshal(data); err != nil {
 		return err
 	}
 
-	if !typeIsRequest(req.Type) || methodFromMsgType(req.Type) != methodBinding ||
-		req.Magic != magic ||
-		int(req.Length+20) != len(data) {
+	if !typeIsRequest(req.Type) || req.Method() != MethodBinding {
 		return errors.New("stun binding get an error format reply")
 	}
 
-	attrReader := bytes.NewBuffer(data[headerLen:])
-	for {
-		if attrReader.Len() == 0 {
-			break
-		}
-		var ahdr attrHeader
-		if err := binary.Read(attrReader, binary.BigEndian, &ahdr); err != nil {
-			return err
-		}
-
-		value := attrReader.Next(int(ahdr.Length))
-		if ahdr.Length%4 != 0 {
-			attrReader.Next(int(4 - ahdr.Length%4))
-		}
+	var err error
+	req.ChangeIp, req.ChangePort, err = req.GetChangeRequest()
+	if err != nil && err != ErrAttributeNotFound {
+		return err
+	}
+	req.Username, _ = req.GetString(AttrUsername)
+	_, req.Fingerprint = req.Get(AttrFingerprint)
 
-		switch ahdr.Type {
-		case attrChangeRequest:
-			req.ChangeIp = (binary.BigEndian.Uint32(value) & 0x04) != 0
-			req.ChangePort = (binary.BigEndian.Uint32(value) & 0x02) != 0
+	var unknown []uint16
+	for _, a := range req.Attributes {
+		if !isKnownAttr(a.Type) {
+			unknown = append(unknown, a.Type)
 		}
 	}
+	if unknown != nil {
+		return &UnknownAttributesError{Attrs: unknown}
+	}
 	return nil
 }
 
 func (resp *StunMessageResp) Marshal() []byte {
-	var buf bytes.Buffer
-
-	binary.Write(&buf, binary.BigEndian, resp.header)
-	if resp.Addr.IP.To4() != nil {
-		binary.Write(&buf, binary.BigEndian, []interface{}{
-			uint16(attrAddress),
-			uint16(attrAddressSizeIpv4),
-			uint8(0),
-			uint8(attrAddressFieldIpv4),
-			uint16(resp.Addr.Port),
-			resp.Addr.IP.To4(),
-		})
-
-		binary.Write(&buf, binary.BigEndian, []interface{}{
-			uint16(attrXorAddress),
-			uint16(attrAddressSizeIpv4),
-			uint8(0),
-			uint8(attrAddressFieldIpv4),
-			uint16(resp.Addr.Port ^ magic>>16),
-		})
-		for i, field := range resp.Addr.IP.To4() {
-			binary.Write(&buf, binary.BigEndian, uint8(field^magicBytes[i]))
-		}
-	} else {
-		binary.Write(&buf, binary.BigEndian, []interface{}{
-			uint16(attrAddress),
-			uint16(attrAddressSizeIpv6),
-			uint8(0),
-			uint8(attrAddressFieldIpv6),
-			uint16(resp.Addr.Port),
-			resp.Addr.IP.To16(),
-		})
-		binary.Write(&buf, binary.BigEndian, []interface{}{
-			uint16(attrXorAddress),
-			uint16(attrAddressSizeIpv6),
-			uint8(0),
-			uint8(attrAddressFieldIpv6),
-			uint16(resp.Addr.Port ^ magic>>16),
-		})
-		for i, field := range resp.Addr.IP.To16() {
-			if i < 4 {
-				binary.Write(&buf, binary.BigEndian, uint8(field^magicBytes[i]))
-			} else {
-				binary.Write(&buf, binary.BigEndian, uint8(field^resp.TransacrtonId[i]))
-			}
-		}
-	}
+	return resp.AppendTo(nil)
+}
 
+// AppendTo appends the response in wire format to b, like Marshal, without
+// allocating when b has enough capacity.
+func (resp *StunMessageResp) AppendTo(b []byte) []byte {
+	start := len(b)
+	b = appendHeader(b, &resp.header)
+	if resp.ErrorCode != 0 {
+		b = appendErrorCode(b, int(resp.ErrorCode), resp.ErrorMsg)
+	}
+	if resp.Addr != nil {
+		key := resp.xorKey()
+		b = appendAddress(b, AttrAddress, resp.Addr, nil)
+		b = appendAddress(b, AttrXorAddress, resp.Addr, &key)
+	}
 	if resp.OtherAddr != nil {
-		if resp.OtherAddr.IP.To4() != nil {
-			binary.Write(&buf, binary.BigEndian, []interface{}{
-				uint16(attrOtherAddress),
-				uint16(attrAddressSizeIpv4),
-				uint8(0),
-				uint8(attrAddressFieldIpv4),
-				uint16(resp.OtherAddr.Port),
-				resp.OtherAddr.IP.To4(),
-			})
-		} else {
-			binary.Write(&buf, binary.BigEndian, []interface{}{
-				uint16(attrOtherAddress),
-				uint16(attrAddressSizeIpv6),
-				uint8(0),
-				uint8(attrAddressFieldIpv6),
-				uint16(resp.OtherAddr.Port),
-				resp.OtherAddr.IP.To16(),
-			})
+		b = appendAddress(b, AttrOtherAddress, resp.OtherAddr, nil)
+	}
+	for _, a := range resp.Attributes {
+		switch a.Type {
+		case AttrErrCode, AttrAddress, AttrXorAddress, AttrOtherAddress, AttrIntegrity, AttrFingerprint:
+		default:
+			b = appendAttr(b, a.Type, a.Value)
 		}
 	}
-
-	resp.Length = uint16(len(buf.Bytes())) - 20
-	buf.Bytes()[2] = byte(resp.Length >> 8)
-	buf.Bytes()[3] = byte(resp.Length)
-
-	return buf.Bytes()
+	if resp.key != nil {
+		b = appendIntegrity(b, start, resp.key)
+	}
+	if resp.Fingerprint {
+		b = appendFingerprint(b, start)
+	}
+	resp.Length = setLength(b[start:])
+	return b
 }
 
 func (resp *StunMessageResp) Unmarshal(data []byte) error {
-	if err := binary.Read(bytes.NewBuffer(data[:headerLen]), binary.BigEndian, &resp.header); err != nil {
+	*resp = StunMessageResp{Message: resp.Message}
+	if err := resp.Message.Unmarshal(data); err != nil {
 		return err
 	}
 
-	if !typeIsSuccessResp(resp.Type) || int(resp.Length+20) != len(data) || resp.Magic != magic {
-		fmt.Println(resp.header)
-		fmt.Println(typeIsSuccessResp(resp.Type), resp.Length, len(data))
+	if typeIsRequest(resp.Type) || typeIsIndication(resp.Type) {
 		return errors.New("stun binding get an error format reply")
 	}
 
-	attrReader := bytes.NewBuffer(data[headerLen:])
-	var haveXor bool
-	for {
-		if attrReader.Len() == 0 {
-			break
-		}
-
-		var ahdr attrHeader
-		if err := binary.Read(attrReader, binary.BigEndian, &ahdr); err != nil {
-			return err
-		}
-
-		value := attrReader.Next(int(ahdr.Length))
-		if ahdr.Length%4 != 0 {
-			attrReader.Next(int(4 - ahdr.Length%4))
-		}
-
-		switch ahdr.Type {
-		case attrAddress:
-			if !haveXor {
-				ip, port, err := parseAddress(value)
-				if err != nil {
-					return err
-				}
-				resp.Addr = &net.UDPAddr{IP: ip, Port: port, Zone: ""}
-			}
-		case attrXorAddress:
-			ip, port, err := parseAddress(value)
-			if err != nil {
-				return err
-			}
-			for i := range ip {
-				ip[i] ^= data[4+i]
-			}
-			port ^= int(binary.BigEndian.Uint16(data[4:]))
-			resp.Addr = &net.UDPAddr{IP: ip, Port: port, Zone: ""}
-			haveXor = true
-		case attrErrCode:
-			resp.ErrorCode = uint16(value[2])*100 + uint16(value[3])
-			resp.ErrorMsg = string(value[4:])
-		case attrOtherAddress:
-			ip, port, err := parseAddress(value)
-			if err != nil {
-				return err
-			}
-			resp.OtherAddr = &net.UDPAddr{IP: ip, Port: port, Zone: ""}
-		default:
-		}
+	var err error
+	resp.Addr, err = resp.GetXorAddress(AttrXorAddress)
+	if err == ErrAttributeNotFound {
+		resp.Addr, err = resp.GetAddress(AttrAddress)
+	}
+	if err != nil && err != ErrAttributeNotFound {
+		return err
+	}
+	resp.OtherAddr, err = resp.GetAddress(AttrOtherAddress)
+	if err != nil && err != ErrAttributeNotFound {
+		return err
 	}
+	code, reason, err := resp.GetErrorCode()
+	if err != nil && err != ErrAttributeNotFound {
+		return err
+	}
+	resp.ErrorCode = uint16(code)
+	resp.ErrorMsg = reason
+	_, resp.Fingerprint = resp.Get(AttrFingerprint)
 	return nil
 }
 
@@ -350,6 +367,10 @@ func typeIsRequest(t uint16) bool {
 	return (t & 0x0110) == 0x0000
 }
 
+func typeIsIndication(t uint16) bool {
+	return (t & 0x0110) == 0x0010
+}
+
 func typeIsSuccessResp(t uint16) bool {
 	return (t & 0x0110) == 0x0100
 }
@@ -361,23 +382,16 @@ func methodFromMsgType(t uint16) uint16 {
 	return (t & 0x000f) | ((t & 0x00e0) >> 1) | ((t & 0x3E00) >> 2)
 }
 
-func NewBindRequest(tid []byte) *StunMessageReq {
-	var req StunMessageReq
+func classFromMsgType(t uint16) uint8 {
+	return uint8((t&0x0100)>>7 | (t&0x0010)>>4)
+}
 
-	if tid == nil {
-		tid = make([]byte, 12)
-		_, err := io.ReadFull(rand.Reader, tid)
-		if err != nil {
-			return nil
-		}
+func NewBindRequest(tid []byte) *StunMessageReq {
+	msg := NewMessage(ClassRequest, MethodBinding, tid)
+	if msg == nil {
+		return nil
 	}
-	copy(req.TransacrtonId[:], tid)
-
-	req.Type = getMsgType(classRequest, methodBinding)
-	req.Length = 0
-	req.Magic = magic
-
-	return &req
+	return &StunMessageReq{Message: *msg}
 }
 
 func (req *StunMessageReq) SetChangeIP(on bool) {
@@ -391,81 +405,359 @@ func (req *StunMessageReq) ValidateSource(souce string) {
 	req.RespSource = souce
 }
 
+// SetShortTermCredentials makes the request carry USERNAME and
+// MESSAGE-INTEGRITY, the integrity of the response is then checked as well.
+func (req *StunMessageReq) SetShortTermCredentials(username, password string) {
+	req.Username = username
+	req.key = ShortTermKey(password)
+}
+
+// SetLongTermCredentials makes the request answer a 401 or 438 challenge of
+// the server with USERNAME, REALM, NONCE and MESSAGE-INTEGRITY.
+func (req *StunMessageReq) SetLongTermCredentials(username, password string) {
+	req.Username = username
+	req.password = password
+}
+
+// CheckShortTermCredentials verifies the MESSAGE-INTEGRITY of a received
+// request with password, on success RespondTo signs the response with it.
+func (req *StunMessageReq) CheckShortTermCredentials(password string) error {
+	key := ShortTermKey(password)
+	if err := req.CheckIntegrity(key); err != nil {
+		return err
+	}
+	req.key = key
+	return nil
+}
+
+// IntegrityKey is the key of the MESSAGE-INTEGRITY of a request once
+// authenticated, RespondTo signs the response with it.
+func (req *StunMessageReq) IntegrityKey() []byte {
+	return req.key
+}
+
+// SetIntegrityKey makes RespondTo sign the response with key, for a server
+// answering a request authenticated by another one.
+func (req *StunMessageReq) SetIntegrityKey(key []byte) {
+	req.key = key
+}
+
 func (req *StunMessageReq) RequestTo(conn *net.UDPConn, to *net.UDPAddr) (*StunMessageResp, *net.UDPAddr, error) {
-	pkConn := ipv4.NewPacketConn(conn)
-	pkConn.SetControlMessage(ipv4.FlagDst, true)
+	return req.RequestToContext(context.Background(), conn, to)
+}
 
-	if err := pkConn.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
-		fmt.Println("Couldn't set the socket timeout:", err)
+// RequestToContext is like RequestTo, but a pending read is aborted and
+// ctx.Err() returned as soon as ctx is done.
+func (req *StunMessageReq) RequestToContext(ctx context.Context, conn *net.UDPConn, to *net.UDPAddr) (*StunMessageResp, *net.UDPAddr, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
 	}
 
 	loc, _ := net.ResolveUDPAddr("udp", conn.LocalAddr().String())
+	return req.requestPacketConn(ctx, newPacketConn(conn), to, loc)
+}
 
-	buf := make([]byte, 1500)
-	for retry := 0; retry < 3; retry++ {
-		_, err := pkConn.WriteTo(req.Marshal(), nil, to)
-		if err != nil {
-			return nil, nil, err
+// abortOnDone makes the pending read fail with setReadDeadline as soon as
+// ctx is done. The returned function stops watching ctx, then clears the
+// deadline, so the connection stays usable after the request.
+func abortOnDone(ctx context.Context, setReadDeadline func(time.Time) error) func() {
+	if ctx.Done() == nil {
+		return func() { setReadDeadline(time.Time{}) }
+	}
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		select {
+		case <-ctx.Done():
+			setReadDeadline(time.Unix(1, 0))
+		case <-stop:
 		}
+	}()
+	return func() {
+		close(stop)
+		<-done
+		setReadDeadline(time.Time{})
+	}
+}
 
-		n, cm, src, err := pkConn.ReadFrom(buf)
-		if err != nil {
-			if err, ok := err.(net.Error); ok && err.Timeout() {
+// requestPacketConn runs the transaction of req over a datagram transport,
+// loc is the local address to report, updated with the destination address
+// of the response when the transport knows it.
+func (req *StunMessageReq) requestPacketConn(ctx context.Context, pkConn packetConn, to *net.UDPAddr, loc *net.UDPAddr) (*StunMessageResp, *net.UDPAddr, error) {
+	defer abortOnDone(ctx, pkConn.SetReadDeadline)()
 
+	for retry := 0; retry < maxChallenges; retry++ {
+		if retry > 0 {
+			if err := req.newTransaction(); err != nil {
+				return nil, nil, err
 			}
-			return nil, nil, err
 		}
-		loc.IP = cm.Dst
 
-		var resp StunMessageResp
-		if err = resp.Unmarshal(buf[:n]); err != nil {
-			return nil, loc, err
+		resp, src, dst, err := req.transact(ctx, pkConn, to)
+		if err != nil {
+			return nil, nil, err
+		}
+		if dst != nil {
+			loc.IP = dst
 		}
+
 		if req.RespSource != "" && src.String() != req.RespSource {
-			return &resp, nil, errors.New("receive packet from unexpected source")
+			return resp, nil, errors.New("receive packet from unexpected source")
+		}
+		if err = req.checkResponse(resp); err == errChallenge {
+			continue
+		} else if err != nil {
+			return resp, loc, err
 		}
-		if resp.ErrorCode != 0 {
-			return &resp, loc, errors.New(resp.ErrorMsg)
+		return resp, loc, nil
+	}
+
+	return nil, nil, errRetryExceeded
+}
+
+// checkResponse validates the response to req, errChallenge means req has
+// been updated to answer an authentication challenge and must be sent again.
+func (req *StunMessageReq) checkResponse(resp *StunMessageResp) error {
+	if req.key != nil && resp.ErrorCode == 0 {
+		if err := resp.CheckIntegrity(req.key); err != nil {
+			return err
 		}
-		if req.TransacrtonId != resp.TransacrtonId ||
-			getMsgType(classResonseSuccess, methodBinding) != resp.Type ||
-			resp.Addr == nil {
-			return &resp, loc, errors.New("receive error response")
+	}
+	if resp.ErrorCode != 0 {
+		if req.handleChallenge(resp) {
+			return errChallenge
 		}
-		return &resp, loc, nil
+		return errors.New(resp.ErrorMsg)
+	}
+	if getMsgType(ClassResponseSuccess, MethodBinding) != resp.Type || resp.Addr == nil {
+		return errors.New("receive error response")
 	}
+	return nil
+}
 
-	return nil, nil, errors.New("request retry exceeds max times")
+// newTransaction gives req a new transaction ID, every authentication retry
+// is a new transaction.
+func (req *StunMessageReq) newTransaction() error {
+	_, err := io.ReadFull(rand.Reader, req.TransacrtonId[:])
+	return err
+}
+
+// transact sends req until a response with the same transaction ID arrives,
+// following the retransmission schedule of the request options. It returns
+// the response, its source and the local address it was received on.
+func (req *StunMessageReq) transact(ctx context.Context, pkConn packetConn, to *net.UDPAddr) (*StunMessageResp, net.Addr, net.IP, error) {
+	opts := req.options()
+	data := req.Marshal()
+	buf := make([]byte, 1500)
+
+	rto := opts.RTO
+	for sent := 1; ; sent++ {
+		if _, err := pkConn.writeTo(data, to); err != nil {
+			return nil, nil, nil, err
+		}
+
+		timeout := rto
+		if sent >= opts.Rc {
+			timeout = time.Duration(opts.Rm) * opts.RTO
+		}
+		if err := pkConn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+			return nil, nil, nil, err
+		}
+		// checked after the deadline is set, so that a cancellation can't be
+		// overridden by it
+		if err := ctx.Err(); err != nil {
+			return nil, nil, nil, err
+		}
+		for {
+			n, dst, src, err := pkConn.readFrom(buf)
+			if err != nil {
+				if ctx.Err() != nil {
+					return nil, nil, nil, ctx.Err()
+				}
+				if err, ok := err.(net.Error); ok && err.Timeout() {
+					break
+				}
+				return nil, nil, nil, err
+			}
+
+			// ignore garbage and late responses of former transactions
+			var resp StunMessageResp
+			if resp.Unmarshal(buf[:n]) != nil || resp.TransacrtonId != req.TransacrtonId {
+				continue
+			}
+			return &resp, src, dst, nil
+		}
+
+		if sent >= opts.Rc {
+			return nil, nil, nil, ErrTimeout
+		}
+		rto *= 2
+	}
+}
+
+func (req *StunMessageReq) options() *ClientOptions {
+	if req.Options != nil {
+		return req.Options
+	}
+	return &DefaultClientOptions
+}
+
+// handleChallenge updates the long-term credentials of req from a 401 or
+// 438 error response, it reports whether the request should be sent again.
+func (req *StunMessageReq) handleChallenge(resp *StunMessageResp) bool {
+	if req.password == "" {
+		return false
+	}
+	realm, errRealm := resp.GetString(AttrRealm)
+	nonce, errNonce := resp.GetString(AttrNonce)
+	if errRealm != nil || errNonce != nil {
+		return false
+	}
+
+	switch resp.ErrorCode {
+	case errUnauthorized:
+		if req.realm != "" {
+			// the credentials were already rejected
+			return false
+		}
+	case errStaleNonce:
+	default:
+		return false
+	}
+	req.realm = realm
+	req.nonce = nonce
+	req.key = LongTermKey(req.Username, realm, req.password)
+	return true
 }
 
 func (req *StunMessageReq) Request(localAddr, remoteAddr string) (*StunMessageResp, *net.UDPAddr, error) {
-	remote, err := net.ResolveUDPAddr("udp", remoteAddr)
+	return req.RequestContext(context.Background(), localAddr, remoteAddr)
+}
+
+// RequestContext sends req from localAddr to remoteAddr, which is host:port,
+// a domain looked up in the SRV records or a stun: URI over udp. When the
+// domain has several servers, they are tried in order until one answers.
+func (req *StunMessageReq) RequestContext(ctx context.Context, localAddr, remoteAddr string) (*StunMessageResp, *net.UDPAddr, error) {
+	u, err := ParseServer(remoteAddr)
 	if err != nil {
 		return nil, nil, err
 	}
-	local, err := net.ResolveUDPAddr("udp", localAddr)
+	if u.Secure() || u.Network() != "udp" {
+		return nil, nil, fmt.Errorf("%s is not a stun server over udp", u)
+	}
+	servers, err := LookupServers(ctx, DefaultResolver, u)
 	if err != nil {
 		return nil, nil, err
 	}
 
+	local, err := net.ResolveUDPAddr("udp", localAddr)
+	if err != nil {
+		return nil, nil, err
+	}
 	sock, err := net.ListenUDP("udp", local)
 	if err != nil {
 		return nil, nil, err
 	}
 	defer sock.Close()
-	return req.RequestTo(sock, remote)
+
+	for _, server := range servers {
+		var remote *net.UDPAddr
+		if remote, err = net.ResolveUDPAddr(UDPNetwork(local), server); err != nil {
+			continue
+		}
+		var resp *StunMessageResp
+		var loc *net.UDPAddr
+		if resp, loc, err = req.RequestToContext(ctx, sock, remote); err == ErrTimeout {
+			continue
+		}
+		return resp, loc, err
+	}
+	return nil, nil, err
+}
+
+// bufPool holds the buffers responses are encoded into before they are sent.
+var bufPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 0, 1500)
+		return &b
+	},
 }
 
 func (req *StunMessageReq) RespondTo(conn *net.UDPConn, to *net.UDPAddr, other *net.UDPAddr) error {
+	b := bufPool.Get().(*[]byte)
+	*b = req.AppendResponse((*b)[:0], to, other)
+	_, err := conn.WriteToUDP(*b, to)
+	bufPool.Put(b)
+	return err
+}
+
+// NewResponse returns the success response to req, mapped is the address
+// the request came from and other the OTHER-ADDRESS of the server, if any.
+func (req *StunMessageReq) NewResponse(mapped *net.UDPAddr, other *net.UDPAddr) *StunMessageResp {
+	var resp StunMessageResp
+	req.initResponse(&resp, mapped, other)
+	return &resp
+}
+
+// AppendResponse appends the success response to req in wire format to b,
+// like NewResponse(mapped, other).Marshal() but without allocating when b has
+// enough capacity.
+func (req *StunMessageReq) AppendResponse(b []byte, mapped *net.UDPAddr, other *net.UDPAddr) []byte {
 	var resp StunMessageResp
+	req.initResponse(&resp, mapped, other)
+	return resp.AppendTo(b)
+}
 
+func (req *StunMessageReq) initResponse(resp *StunMessageResp, mapped *net.UDPAddr, other *net.UDPAddr) {
 	resp.TransacrtonId = req.TransacrtonId
-	resp.Type = getMsgType(classResonseSuccess, methodBinding)
-	resp.Length = 0
+	resp.Type = getMsgType(ClassResponseSuccess, MethodBinding)
 	resp.Magic = magic
-	resp.Addr = to
+	resp.Addr = mapped
 	resp.OtherAddr = other
+	resp.key = req.key
+	resp.Fingerprint = req.Fingerprint
+}
+
+// NewErrorResponse returns an error response to req, reason defaults to the
+// standard reason phrase of code.
+func (req *StunMessageReq) NewErrorResponse(code int, reason string) *StunMessageResp {
+	var resp StunMessageResp
+
+	if reason == "" {
+		reason = errReasons[code]
+	}
+	resp.TransacrtonId = req.TransacrtonId
+	resp.Type = getMsgType(ClassError, req.Method())
+	resp.Magic = magic
+	resp.ErrorCode = uint16(code)
+	resp.ErrorMsg = reason
+	resp.Fingerprint = req.Fingerprint
+
+	return &resp
+}
+
+// ErrorResponse returns the error response to a request that failed to
+// Unmarshal with err: 420 with UNKNOWN-ATTRIBUTES or 400 Bad Request. It
+// returns nil when the packet is not a STUN request and must be dropped.
+func (req *StunMessageReq) ErrorResponse(err error) *StunMessageResp {
+	if e, ok := err.(*UnknownAttributesError); ok {
+		resp := req.NewErrorResponse(errUnknownAttribute, "")
+		resp.SetUnknownAttributes(e.Attrs)
+		return resp
+	}
+	if err == ErrFingerprint || req.Magic != magic || !typeIsRequest(req.Type) {
+		return nil
+	}
+	return req.NewErrorResponse(errBadRequest, "")
+}
+
+// RespondInternalError answers req with 500 Server Error.
+func (req *StunMessageReq) RespondInternalError(conn *net.UDPConn, to *net.UDPAddr) error {
+	return req.RespondError(conn, to, errServerInternal, "")
+}
 
-	_, err := conn.WriteTo(resp.Marshal(), to)
+func (req *StunMessageReq) RespondError(conn *net.UDPConn, to *net.UDPAddr, code int, reason string) error {
+	_, err := conn.WriteTo(req.NewErrorResponse(code, reason).Marshal(), to)
 	return err
 }
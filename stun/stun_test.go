@@ -0,0 +1,482 @@
+package stun
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+var (
+	benchMapped = &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 32853}
+	benchOther  = &net.UDPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 3479}
+)
+
+// bindingTransaction is the work of the server for one Binding request:
+// decode it into a reused request and encode the response into a reused
+// buffer.
+func bindingTransaction(req *StunMessageReq, data, buf []byte) ([]byte, error) {
+	if err := req.Unmarshal(data); err != nil {
+		return nil, err
+	}
+	return req.AppendResponse(buf[:0], benchMapped, benchOther), nil
+}
+
+func bindingRequest(fingerprint bool) []byte {
+	req := NewBindRequest(nil)
+	req.Fingerprint = fingerprint
+	return req.Marshal()
+}
+
+func TestAppendResponse(t *testing.T) {
+	var req StunMessageReq
+	data := bindingRequest(true)
+	b, err := bindingTransaction(&req, data, make([]byte, 0, 1500))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := req.NewResponse(benchMapped, benchOther).Marshal(); !bytes.Equal(b, want) {
+		t.Fatalf("appended\n% x\nmarshaled\n% x", b, want)
+	}
+
+	// encoding after something already in the buffer
+	b = req.AppendResponse([]byte{0xff}, benchMapped, nil)
+	var resp StunMessageResp
+	if err := resp.Unmarshal(b[1:]); err != nil {
+		t.Fatal(err)
+	}
+	if !resp.Fingerprint || resp.Addr.String() != benchMapped.String() {
+		t.Errorf("bad response %+v", resp)
+	}
+}
+
+func TestBindingTransactionAllocs(t *testing.T) {
+	for _, fingerprint := range []bool{false, true} {
+		var req StunMessageReq
+		data := bindingRequest(fingerprint)
+		buf := make([]byte, 0, 1500)
+		allocs := testing.AllocsPerRun(100, func() {
+			if _, err := bindingTransaction(&req, data, buf); err != nil {
+				t.Fatal(err)
+			}
+		})
+		if allocs != 0 {
+			t.Errorf("fingerprint %v: %v allocations per transaction", fingerprint, allocs)
+		}
+	}
+}
+
+func BenchmarkBindingTransaction(b *testing.B) {
+	var req StunMessageReq
+	data := bindingRequest(false)
+	buf := make([]byte, 0, 1500)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	for i := 0; i < b.N; i++ {
+		bindingTransaction(&req, data, buf)
+	}
+}
+
+func BenchmarkBindingTransactionFingerprint(b *testing.B) {
+	var req StunMessageReq
+	data := bindingRequest(true)
+	buf := make([]byte, 0, 1500)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	for i := 0; i < b.N; i++ {
+		bindingTransaction(&req, data, buf)
+	}
+}
+
+func BenchmarkRequestUnmarshal(b *testing.B) {
+	var req StunMessageReq
+	data := bindingRequest(true)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		req.Unmarshal(data)
+	}
+}
+
+func BenchmarkResponseAppendTo(b *testing.B) {
+	req := NewBindRequest(nil)
+	resp := req.NewResponse(benchMapped, benchOther)
+	buf := make([]byte, 0, 1500)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		buf = resp.AppendTo(buf[:0])
+	}
+}
+
+func BenchmarkResponseMarshal(b *testing.B) {
+	req := NewBindRequest(nil)
+	resp := req.NewResponse(benchMapped, benchOther)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		resp.Marshal()
+	}
+}
+
+func TestErrorResponse(t *testing.T) {
+	request := func(class uint8, method uint16, attrs ...Attribute) []byte {
+		msg := NewMessage(class, method, nil)
+		msg.Attributes = attrs
+		return msg.Marshal()
+	}
+	badFingerprint := NewBindRequest(nil)
+	badFingerprint.Fingerprint = true
+	data := badFingerprint.Marshal()
+	data[len(data)-1] ^= 0xff
+
+	cases := []struct {
+		name    string
+		data    []byte
+		code    int
+		unknown []uint16
+	}{
+		{"unknown attributes", request(ClassRequest, MethodBinding, Attribute{0x0004, []byte{0, 0, 0, 0}}, Attribute{0x7fff, nil}), 420, []uint16{0x0004, 0x7fff}},
+		{"unknown optional attribute", request(ClassRequest, MethodBinding, Attribute{0x8055, []byte{1}}), 0, nil},
+		{"bad CHANGE-REQUEST", request(ClassRequest, MethodBinding, Attribute{AttrChangeRequest, []byte{0, 4}}), 400, nil},
+		{"other method", request(ClassRequest, 0x003), 400, nil},
+		{"indication", request(ClassIndication, MethodBinding, Attribute{0x0004, nil}), -1, nil},
+		{"bad fingerprint", data, -1, nil},
+		{"not stun", []byte("GET / HTTP/1.1\r\n\r\n\r\n"), -1, nil},
+	}
+	for _, c := range cases {
+		var req StunMessageReq
+		err := req.Unmarshal(c.data)
+		if c.code == 0 {
+			if err != nil {
+				t.Errorf("%s: %v", c.name, err)
+			}
+			continue
+		}
+		if err == nil {
+			t.Errorf("%s: accepted", c.name)
+			continue
+		}
+		errResp := req.ErrorResponse(err)
+		if c.code < 0 {
+			if errResp != nil {
+				t.Errorf("%s: answered with %d", c.name, errResp.ErrorCode)
+			}
+			continue
+		}
+		if errResp == nil {
+			t.Errorf("%s: dropped", c.name)
+			continue
+		}
+
+		var resp StunMessageResp
+		if err = resp.Unmarshal(errResp.Marshal()); err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if resp.Class() != ClassError || resp.Method() != req.Method() || resp.TransacrtonId != req.TransacrtonId {
+			t.Errorf("%s: class %d method %#x", c.name, resp.Class(), resp.Method())
+		}
+		v, _ := resp.Get(AttrErrCode)
+		if len(v) < 4 || int(v[2]&0x07) != c.code/100 || int(v[3]) != c.code%100 {
+			t.Errorf("%s: ERROR-CODE % x, want %d", c.name, v, c.code)
+		}
+		if code, reason, err := resp.GetErrorCode(); err != nil || code != c.code || reason != errReasons[c.code] {
+			t.Errorf("%s: error %d %q %v", c.name, code, reason, err)
+		}
+		if unknown, err := resp.GetUnknownAttributes(); c.unknown != nil && (err != nil || fmt.Sprint(unknown) != fmt.Sprint(c.unknown)) {
+			t.Errorf("%s: UNKNOWN-ATTRIBUTES %#04x %v", c.name, unknown, err)
+		}
+	}
+}
+
+// TestErrorResponseReused decodes junk into the request of a valid one, as
+// the server does with the request it reuses for every packet: the junk must
+// not be answered with the header of the former request.
+func TestErrorResponseReused(t *testing.T) {
+	badMagic := bindingRequest(false)
+	badMagic[4] ^= 0xff
+	var req StunMessageReq
+	for _, junk := range [][]byte{
+		{0x01},
+		[]byte("hello"),
+		[]byte("GET / HTTP/1.1\r\n\r\n\r\n"),
+		{0xc0, 0x01, 0, 0, 0x21, 0x12, 0xa4, 0x42, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0},
+		badMagic,
+	} {
+		if err := req.Unmarshal(bindingRequest(true)); err != nil {
+			t.Fatal(err)
+		}
+		former := req.TransacrtonId
+		err := req.Unmarshal(junk)
+		if err == nil {
+			t.Fatalf("%q accepted", junk)
+		}
+		if resp := req.ErrorResponse(err); resp != nil {
+			t.Errorf("%q answered with %d", junk, resp.ErrorCode)
+		}
+		if req.TransacrtonId == former || len(req.Attributes) != 0 {
+			t.Errorf("%q left the former request in %+v", junk, req.header)
+		}
+	}
+}
+
+func TestRespondInternalError(t *testing.T) {
+	server, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	req := NewBindRequest(nil)
+	if err = req.RespondInternalError(server, client.LocalAddr().(*net.UDPAddr)); err != nil {
+		t.Fatal(err)
+	}
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 1500)
+	n, _, err := client.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var resp StunMessageResp
+	if err = resp.Unmarshal(buf[:n]); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Class() != ClassError || resp.ErrorCode != 500 || resp.ErrorMsg != errReasons[500] {
+		t.Errorf("response %d %q", resp.ErrorCode, resp.ErrorMsg)
+	}
+}
+
+// lossyServer answers the Binding requests it receives after dropping the
+// first drop ones, a negative drop never answers. It returns its address and
+// a function returning the times the requests arrived at, since the first.
+func lossyServer(t *testing.T, drop int) (*net.UDPAddr, func() []time.Duration) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	var mu sync.Mutex
+	var arrivals []time.Time
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, remote, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			var req StunMessageReq
+			if req.Unmarshal(buf[:n]) != nil {
+				continue
+			}
+			mu.Lock()
+			arrivals = append(arrivals, time.Now())
+			answer := drop >= 0 && len(arrivals) > drop
+			mu.Unlock()
+			if answer {
+				req.RespondTo(conn, remote, nil)
+			}
+		}
+	}()
+	return conn.LocalAddr().(*net.UDPAddr), func() []time.Duration {
+		mu.Lock()
+		defer mu.Unlock()
+		var offsets []time.Duration
+		for _, a := range arrivals {
+			offsets = append(offsets, a.Sub(arrivals[0]))
+		}
+		return offsets
+	}
+}
+
+// within reports whether d is want, give or take the scheduling jitter.
+func within(d, want time.Duration) bool {
+	return d >= want-5*time.Millisecond && d <= want+50*time.Millisecond
+}
+
+func TestRetransmission(t *testing.T) {
+	const rto = 40 * time.Millisecond
+	options := &ClientOptions{RTO: rto, Rc: 4, Rm: 3}
+	// the request is sent at 0, RTO, 3 RTO and 7 RTO
+	schedule := []time.Duration{0, rto, 3 * rto, 7 * rto}
+
+	for drop := 0; drop < options.Rc; drop++ {
+		server, arrivals := lossyServer(t, drop)
+		req := NewBindRequest(nil)
+		req.Options = options
+		start := time.Now()
+		if _, _, err := req.Request("127.0.0.1:0", server.String()); err != nil {
+			t.Fatalf("%d dropped: %v", drop, err)
+		}
+		elapsed := time.Since(start)
+		got := arrivals()
+		if len(got) != drop+1 {
+			t.Fatalf("%d dropped: %d requests", drop, len(got))
+		}
+		for i, d := range got {
+			if !within(d, schedule[i]) {
+				t.Errorf("%d dropped: request %d sent at %s, want %s", drop, i, d, schedule[i])
+			}
+		}
+		if !within(elapsed, schedule[drop]) {
+			t.Errorf("%d dropped: answered after %s", drop, elapsed)
+		}
+	}
+
+	// without any answer, the client gives up Rm times RTO after the last
+	// request
+	server, arrivals := lossyServer(t, -1)
+	req := NewBindRequest(nil)
+	req.Options = options
+	start := time.Now()
+	if _, _, err := req.Request("127.0.0.1:0", server.String()); err != ErrTimeout {
+		t.Fatalf("error %v, want %v", err, ErrTimeout)
+	}
+	elapsed := time.Since(start)
+	got := arrivals()
+	if len(got) != options.Rc {
+		t.Fatalf("%d requests, want %d", len(got), options.Rc)
+	}
+	if want := schedule[len(schedule)-1] + time.Duration(options.Rm)*rto; !within(elapsed, want) {
+		t.Errorf("timed out after %s, want %s", elapsed, want)
+	}
+}
+
+// TestAbortOnDone cancels the context as the request returns: the deadline
+// of the connection is cleared last whichever wins.
+func TestAbortOnDone(t *testing.T) {
+	for i := 0; i < 1000; i++ {
+		var mu sync.Mutex
+		var deadlines []time.Time
+		setReadDeadline := func(d time.Time) error {
+			mu.Lock()
+			deadlines = append(deadlines, d)
+			mu.Unlock()
+			return nil
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		stop := abortOnDone(ctx, setReadDeadline)
+		go cancel()
+		stop()
+		time.Sleep(10 * time.Microsecond)
+
+		mu.Lock()
+		if last := deadlines[len(deadlines)-1]; !last.IsZero() {
+			t.Fatalf("deadline %v left after %v", last, deadlines)
+		}
+		mu.Unlock()
+	}
+}
+
+func TestRequestContext(t *testing.T) {
+	server, _ := lossyServer(t, -1)
+	options := &ClientOptions{RTO: time.Second, Rc: 7, Rm: 16}
+
+	// a cancellation aborts the pending read
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	req := NewBindRequest(nil)
+	req.Options = options
+	start := time.Now()
+	if _, _, err = req.RequestToContext(ctx, conn, server); err != context.Canceled {
+		t.Errorf("error %v, want %v", err, context.Canceled)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("returned %s after the cancellation", elapsed)
+	}
+
+	// the socket of the caller is usable again, without the deadline which
+	// aborted the read
+	answering, _ := lossyServer(t, 0)
+	if _, _, err = req.RequestToContext(context.Background(), conn, answering); err != nil {
+		t.Errorf("request after the cancellation: %v", err)
+	}
+
+	// a deadline stops RequestContext, which releases its socket
+	local := conn.LocalAddr().String()
+	conn.Close()
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start = time.Now()
+	if _, _, err = req.RequestContext(ctx, local, server.String()); err != context.DeadlineExceeded {
+		t.Errorf("error %v, want %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("returned %s after the deadline", elapsed)
+	}
+	addr, _ := net.ResolveUDPAddr("udp", local)
+	if conn, err = net.ListenUDP("udp", addr); err != nil {
+		t.Errorf("socket not released: %v", err)
+	} else {
+		conn.Close()
+	}
+
+	// a done context fails at once
+	if _, _, err = req.RequestContext(ctx, "127.0.0.1:0", server.String()); err != context.DeadlineExceeded {
+		t.Errorf("error %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+// bindingServer answers the Binding requests received on ip.
+func bindingServer(t *testing.T, ip net.IP) *net.UDPAddr {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: ip})
+	if err != nil {
+		t.Skip("no ", ip, ": ", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, remote, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			var req StunMessageReq
+			if req.Unmarshal(buf[:n]) == nil {
+				req.RespondTo(conn, remote, nil)
+			}
+		}
+	}()
+	return conn.LocalAddr().(*net.UDPAddr)
+}
+
+func TestRequestIPv6(t *testing.T) {
+	server := bindingServer(t, net.IPv6loopback)
+	server4 := bindingServer(t, net.IPv4(127, 0, 0, 1))
+
+	for _, c := range []struct {
+		local  string
+		server *net.UDPAddr
+		ip     net.IP
+	}{
+		{"[::1]:0", server, net.IPv6loopback},
+		// the local address is the destination of the response, given by
+		// IPV6_PKTINFO
+		{"[::]:0", server, net.IPv6loopback},
+		// a dual-stack socket to an IPv4 server
+		{"[::]:0", server4, net.IPv4(127, 0, 0, 1)},
+	} {
+		req := NewBindRequest(nil)
+		req.Options = &ClientOptions{RTO: 100 * time.Millisecond, Rc: 3, Rm: 4}
+		resp, local, err := req.Request(c.local, c.server.String())
+		if err != nil {
+			t.Errorf("%s to %s: %v", c.local, c.server, err)
+			continue
+		}
+		if !local.IP.Equal(c.ip) || local.Port == 0 {
+			t.Errorf("%s to %s: local address %s, want %s", c.local, c.server, local, c.ip)
+		}
+		if !resp.Addr.IP.Equal(local.IP) || resp.Addr.Port != local.Port {
+			t.Errorf("%s to %s: mapped address %s, want %s", c.local, c.server, resp.Addr, local)
+		}
+	}
+}
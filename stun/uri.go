@@ -0,0 +1,156 @@
+package stun
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+)
+
+const (
+	DefaultPort    = 3478
+	DefaultTLSPort = 5349
+)
+
+var ErrBadURI = errors.New("bad stun uri")
+
+// URI is a stun: or stuns: URI, RFC 7064:
+//
+//	stun:host[:port][?transport=udp|tcp]
+//	stuns:host[:port][?transport=udp|tcp]
+//
+// IPv6 literals are enclosed in brackets, e.g. stun:[2001:db8::1]:3478.
+type URI struct {
+	Scheme string
+	Host   string
+	// Port is 0 when the URI doesn't specify it.
+	Port int
+	// Transport is "udp", "tcp" or "" when the URI doesn't specify it.
+	Transport string
+}
+
+func ParseURI(raw string) (*URI, error) {
+	var u URI
+
+	i := strings.IndexByte(raw, ':')
+	if i < 0 {
+		return nil, ErrBadURI
+	}
+	u.Scheme = strings.ToLower(raw[:i])
+	rest := raw[i+1:]
+	if u.Scheme != "stun" && u.Scheme != "stuns" {
+		return nil, ErrBadURI
+	}
+
+	if i = strings.IndexByte(rest, '?'); i >= 0 {
+		query := rest[i+1:]
+		rest = rest[:i]
+		if !strings.HasPrefix(query, "transport=") {
+			return nil, ErrBadURI
+		}
+		u.Transport = strings.ToLower(strings.TrimPrefix(query, "transport="))
+		if u.Transport != "udp" && u.Transport != "tcp" {
+			return nil, ErrBadURI
+		}
+	}
+
+	// there is no authority, stun://host is invalid
+	if rest == "" || strings.HasPrefix(rest, "/") {
+		return nil, ErrBadURI
+	}
+	var port string
+	if rest[0] == '[' {
+		end := strings.IndexByte(rest, ']')
+		if end < 0 {
+			return nil, ErrBadURI
+		}
+		u.Host = rest[1:end]
+		if ip := net.ParseIP(u.Host); ip == nil || ip.To4() != nil {
+			return nil, ErrBadURI
+		}
+		switch rest = rest[end+1:]; {
+		case rest == "":
+		case rest[0] == ':':
+			port = rest[1:]
+		default:
+			return nil, ErrBadURI
+		}
+	} else {
+		u.Host = rest
+		if i = strings.IndexByte(rest, ':'); i >= 0 {
+			u.Host, port = rest[:i], rest[i+1:]
+		}
+		if u.Host == "" || strings.ContainsAny(u.Host, ":/[]@") {
+			return nil, ErrBadURI
+		}
+	}
+
+	if port != "" || strings.HasSuffix(rest, ":") {
+		p, err := strconv.Atoi(port)
+		if err != nil || p <= 0 || p > 65535 {
+			return nil, ErrBadURI
+		}
+		u.Port = p
+	}
+	return &u, nil
+}
+
+// Secure reports whether the URI is stuns:, STUN over TLS or DTLS.
+func (u *URI) Secure() bool {
+	return u.Scheme == "stuns"
+}
+
+// Network returns the transport to reach the server: "udp" or "tcp" as
+// specified, by default UDP for stun: and TLS over TCP for stuns:.
+func (u *URI) Network() string {
+	if u.Transport != "" {
+		return u.Transport
+	}
+	if u.Secure() {
+		return "tcp"
+	}
+	return "udp"
+}
+
+// Addr returns host:port with the default port of the scheme when the URI
+// doesn't specify it, with brackets around an IPv6 host.
+func (u *URI) Addr() string {
+	port := u.Port
+	if port == 0 {
+		port = DefaultPort
+		if u.Secure() {
+			port = DefaultTLSPort
+		}
+	}
+	return net.JoinHostPort(u.Host, strconv.Itoa(port))
+}
+
+func (u *URI) String() string {
+	s := u.Scheme + ":" + u.Host
+	if strings.IndexByte(u.Host, ':') >= 0 {
+		s = u.Scheme + ":[" + u.Host + "]"
+	}
+	if u.Port != 0 {
+		s += ":" + strconv.Itoa(u.Port)
+	}
+	if u.Transport != "" {
+		s += "?transport=" + u.Transport
+	}
+	return s
+}
+
+// ParseServer accepts a stun: or stuns: URI as well as a plain host[:port],
+// which is taken as a stun: URI.
+func ParseServer(server string) (*URI, error) {
+	if IsURI(server) {
+		return ParseURI(server)
+	}
+	return ParseURI("stun:" + server)
+}
+
+// IsURI reports whether s starts with the stun: or stuns: scheme, as
+// opposed to a plain host:port.
+func IsURI(s string) bool {
+	s = strings.ToLower(s)
+	return strings.HasPrefix(s, "stun:") || strings.HasPrefix(s, "stuns:")
+}
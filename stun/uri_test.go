@@ -0,0 +1,85 @@
+package stun
+
+import "testing"
+
+func TestParseURI(t *testing.T) {
+	for _, c := range []struct {
+		raw     string
+		uri     URI
+		network string
+		addr    string
+	}{
+		{"stun:stun.example.org", URI{"stun", "stun.example.org", 0, ""}, "udp", "stun.example.org:3478"},
+		{"stuns:stun.example.org", URI{"stuns", "stun.example.org", 0, ""}, "tcp", "stun.example.org:5349"},
+		{"STUN:stun.example.org:19302", URI{"stun", "stun.example.org", 19302, ""}, "udp", "stun.example.org:19302"},
+		{"stun:1.2.3.4?transport=tcp", URI{"stun", "1.2.3.4", 0, "tcp"}, "tcp", "1.2.3.4:3478"},
+		{"stuns:1.2.3.4:443?transport=TCP", URI{"stuns", "1.2.3.4", 443, "tcp"}, "tcp", "1.2.3.4:443"},
+		// stuns: over UDP is DTLS
+		{"stuns:stun.example.org?transport=udp", URI{"stuns", "stun.example.org", 0, "udp"}, "udp", "stun.example.org:5349"},
+		{"stun:[2001:db8::1]", URI{"stun", "2001:db8::1", 0, ""}, "udp", "[2001:db8::1]:3478"},
+		{"stuns:[2001:db8::1]:5350?transport=tcp", URI{"stuns", "2001:db8::1", 5350, "tcp"}, "tcp", "[2001:db8::1]:5350"},
+	} {
+		u, err := ParseURI(c.raw)
+		if err != nil {
+			t.Errorf("%s: %v", c.raw, err)
+			continue
+		}
+		if *u != c.uri || u.Network() != c.network || u.Addr() != c.addr {
+			t.Errorf("%s: %+v %s %s, want %+v %s %s", c.raw, *u, u.Network(), u.Addr(), c.uri, c.network, c.addr)
+		}
+		// String gives back the URI it was parsed from
+		if v, err := ParseURI(u.String()); err != nil || *v != *u {
+			t.Errorf("%s: %s parsed as %+v %v", c.raw, u, v, err)
+		}
+	}
+
+	for _, raw := range []string{
+		"",
+		"stun.example.org",
+		"turn:stun.example.org",
+		"http://stun.example.org",
+		"stun:",
+		"stun://stun.example.org",
+		"stun:stun.example.org:",
+		"stun:stun.example.org:0",
+		"stun:stun.example.org:65536",
+		"stun:stun.example.org:-1",
+		"stun:stun.example.org:port",
+		"stun:2001:db8::1",
+		"stun:[2001:db8::1",
+		"stun:[2001:db8::1]3478",
+		"stun:[1.2.3.4]",
+		"stun:[stun.example.org]",
+		"stun:user@stun.example.org",
+		"stun:stun.example.org?transport=sctp",
+		"stun:stun.example.org?foo=bar",
+	} {
+		if u, err := ParseURI(raw); err != ErrBadURI {
+			t.Errorf("%q parsed as %+v %v", raw, u, err)
+		}
+	}
+}
+
+func TestParseServer(t *testing.T) {
+	for _, c := range []struct {
+		server string
+		uri    URI
+	}{
+		{"stun.example.org", URI{"stun", "stun.example.org", 0, ""}},
+		{"stun.l.google.com:19302", URI{"stun", "stun.l.google.com", 19302, ""}},
+		{"[2001:db8::1]:3478", URI{"stun", "2001:db8::1", 3478, ""}},
+		{"stuns:stun.example.org", URI{"stuns", "stun.example.org", 0, ""}},
+		{"Stun:1.2.3.4?transport=tcp", URI{"stun", "1.2.3.4", 0, "tcp"}},
+	} {
+		u, err := ParseServer(c.server)
+		if err != nil || *u != c.uri {
+			t.Errorf("%s: %+v %v, want %+v", c.server, u, err, c.uri)
+		}
+	}
+
+	for _, server := range []string{"", "stun.example.org:99999", "2001:db8::1", "turn:stun.example.org"} {
+		if u, err := ParseServer(server); err == nil {
+			t.Errorf("%q parsed as %+v", server, u)
+		}
+	}
+}